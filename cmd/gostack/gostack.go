@@ -0,0 +1,85 @@
+/*
+Gostack: symbolize Go user stacks in kernel traces
+
+Usage:
+
+	gostack [-base addr | -pid pid] program [trace]
+
+Gostack copies a kernel trace, read from the trace file or the standard
+input, to the standard output, replacing the entries of user stack
+traces, like those recorded with the userstacktrace trace option, by the
+Go function calls they stand for, including the calls inlined by the
+compiler. program is the executable that ran when the trace was
+recorded.
+
+Entries printed as offsets in the mapped files, with the sym-userobj
+trace option, need nothing more. Entries printed as addresses in
+position independent executables need the address the start of the
+executable was mapped at, its load base, which is different in every
+process. It's given by -base, or read from the memory mappings of the
+still running process -pid.
+
+Flags:
+
+	-base=0: load base of position independent programs
+	-pid=0: read the load base of the program from running process pid
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"mgk.ro/godebug"
+	_ "mgk.ro/log"
+)
+
+var (
+	base = flag.Uint64("base", 0, "load base of position independent programs")
+	pid  = flag.Int("pid", 0, "read the load base of the program from running process pid")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: gostack [-base addr | -pid pid] program [trace]\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 && flag.NArg() != 2 {
+		flag.Usage()
+	}
+	prg, err := godebug.NewProg(exec.Command(flag.Arg(0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer prg.Close()
+	s := godebug.NewSymbolizer(prg)
+	switch {
+	case *pid != 0:
+		b, err := prg.LoadBase(*pid)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.Base = func(int) (uint64, bool) { return b, true }
+	case *base != 0:
+		s.Base = func(int) (uint64, bool) { return *base, true }
+	}
+	in := os.Stdin
+	if flag.NArg() == 2 {
+		in, err = os.Open(flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer in.Close()
+	}
+	if err := s.Copy(os.Stdout, in); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -2,55 +2,182 @@
 Gotrace: go function tracer
 
 Usage:
+
 	gotrace [options] command [args]
+	gotrace [options] -p pid
+	gotrace cleanup
 
 Flags:
 
-  -filter='.': only trace functions matching regexp; can be set multiple times
-  -o="": print to file instead of stderr
-  -ret=true: trace return from function
-  -run=true: run the command
-  -trace=true: enables tracing; false makes program print uprobes to output
-  -leavetrace=false: leaves tracing on
+	-arg="": fetch a parameter, a local variable at -at lines, or a field path like req.URL.Path where there is one; can be set multiple times
+	-at="": trace execution of source line file:line; can be set multiple times
+	-c=false: also trace C functions matching -filter, including those in shared libraries
+	-debugdir=/usr/lib/debug: look for separate debug info in dir; can be set multiple times
+	-filter='.': only trace functions matching regexp; can be set multiple times
+	-follow=false: also trace the processes started by the traced process
+	-format=text: output format, text for the kernel trace or jsonl for JSON Lines
+	-impl="": trace the methods of every type implementing an interface like io.Writer, or one method like io.Writer.Write; can be set multiple times
+	-global="": fetch a package level variable or a field path like main.config.Addr in every Go probe; can be set multiple times
+	-list=false: list the selected functions and their source position, then exit
+	-names="": write the table mapping event names back to Go names to file
+	-o="": print to file instead of stderr
+	-p=0: trace running process pid instead of running a command
+	-ret=true: trace return from function
+	-run=true: run the command
+	-stack=false: record the user stack of every event, as Go frames
+	-select="": only trace functions matching selector; can be set multiple times
+	-trace=true: enables tracing; false makes program print uprobes to output
+	-tracefs=/sys/kernel/debug/tracing: directory of the kernel tracing files
+	-unsafe=false: also trace functions that are unsafe to probe
+	-leavetrace=false: leaves tracing on
+
+Only the process running the command is traced, not the other
+instances of the program running on the machine. The command starts
+stopped until tracing is restricted to it, so no events are lost. With
+-follow, the processes it starts, and the processes they start, are
+traced too.
+
+Every gotrace uses its own probes, in the uprobe group gotrace_pid, and
+its own tracing instance, instances/gotrace_pid in the -tracefs
+directory, and removes them when done. Several gotraces can run at the
+same time, even on the same program, without disturbing each other or
+the other users of kernel tracing.
+
+Sessions record what they install in a state file in /run/gotrace. If
+gotrace dies without cleaning up, the next gotrace that traces removes
+what it left behind. So does gotrace cleanup, which also disables the
+tracing left on with -leavetrace. It takes no flags; to trace a command
+named cleanup, give it as a path, like ./cleanup, or after a flag or --.
+
+With -p, gotrace traces a running process instead of running a command.
+The program is the executable of the process, as found through
+/proc/pid/exe. The process is neither stopped nor signaled; gotrace
+stops tracing when interrupted or when the process exits.
+
+Selectors select functions by package, receiver, name, source file and
+other properties, for example
+
+	gotrace -select='pkg:net/http recv:*response method:Write* !file:*_test.go' server
+
+See godebug.Selector for the syntax. Functions are traced if they match
+any -filter or any -select.
+
+To trace calls through an interface, -impl traces the methods of every
+type of the program that implements the interface, named with its
+package path. For example
+
+	gotrace -impl=io.Writer.Write server
+
+traces (*os.File).Write, (*bufio.Writer).Write, and so on. The events
+are named after the interface, the method and the concrete type, as in
+io.Writer.Write(*os.File), mangled to io_Writer_Write_os_File.
+
+Function entry probes record the arguments as described by the runtime
+symbol table, each both unsigned and signed, as h0 and d0 for the first
+argument, h1_0 and d1_0 for the first field of the second one, and so
+on. Using the debug info of the program, they can also fetch parameters
+and the fields they point to. For example
+
+	gotrace -select='pkg:net/http method:ServeHTTP' -arg=r.URL.Path -arg=r.Method server
+
+records the path and method of every request. Strings are recorded
+along with their length, arg_len. Similarly, -global records package
+level variables in every probe of the Go program. Line probes set with
+-at can also fetch the local variables in scope at the line, when the
+optimized code keeps them somewhere a probe can read.
+
+With -stack, every event is followed by the user stack of the thread,
+innermost call first, with the calls inlined by the compiler. The kernel
+walks the stack by frame pointers, so at function entry, before the
+function sets up its frame, the stack misses the caller. Traces saved
+without -stack's symbolization can be symbolized later with gostack.
+
+With -format=jsonl, every event is written as a JSON object on its own
+line, with the timestamp, cpu, pid and tid, the goroutine as goid, the
+Go function, and the kind of event: entry, return, inline or line (with
+the position instead of the function). Events of -impl name the method
+of the concrete type as the function, with the interface and the type
+apart. Arguments and results are named
+after the Go expressions they read, like v.a for a field of argument v,
+and decoded as numbers, or strings for strings. Without debug info,
+arguments are named after their position, like arg1_0. Results are
+only read from integer registers, which needs debug info and the
+register ABI. The -stack frames are in stack. Events the kernel dropped
+are reported as lost records, and events whose arguments were cut short
+are marked truncated.
+
+Event names are mangled Go names, like main_run_func1. The -names table
+maps them back to the Go names and describes each event; anonymous
+functions are described by the function literal, defer or go statement
+they come from, as in "call of func literal at main.go:16 in main.run".
+
+Functions that can't be probed without risking to hang or crash the
+program, like runtime.morestack, signal handlers and nosplit runtime
+functions, are skipped unless -unsafe is set. -list shows why.
 */
 package main
 
-// BUG(aram): Only one instance of the program can be run concurrently.
-// BUG(aram): If this program crashes, it might leave tracing enabled.
-// BUG(aram): After normal exit, this program will leave probes behind (but disabled).
-// BUG(aram): This program will completely reset kernel tracing state.
-// BUG(aram): This program will trace every instance of the specified program, including existing ones.
-// BUG(aram): This program takes forever to exit.
+// BUG(aram): Disabling the probes at exit takes the kernel about a hundredth of a second each, so with more than a hundred or so probes gotrace takes longer than a second to exit.
 // BUG(aram): This program uses uprobes, which are Linux-specific and lack functionality.
 // BUG(aram): This program would not be necessary if Linux had DTrace and Go supported DTrace better.
 
 import (
-	"fmt"
+	"bufio"
+	"context"
+	"debug/dwarf"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
 	"io"
+	"log"
 	"os"
 	"os/exec"
 	"os/signal"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"mgk.ro/debugfs"
 	"mgk.ro/godebug"
 	_ "mgk.ro/log"
+	"mgk.ro/uprobes"
 )
 
 var (
 	ofile     = flag.String("o", "", "print to file instead of stderr")
+	namesFile = flag.String("names", "", "write the table mapping event names back to Go names to file")
 	run       = flag.Bool("run", true, "run the command")
 	traceRet  = flag.Bool("ret", true, "trace return from function")
+	traceC    = flag.Bool("c", false, "also trace C functions matching -filter, including those in shared libraries")
+	list      = flag.Bool("list", false, "list the selected functions and their source position, then exit")
 	tracing   = flag.Bool("trace", true, "enables tracing; false makes program print uprobes to output")
+	unsafe    = flag.Bool("unsafe", false, "also trace functions that are unsafe to probe")
+	stacks    = flag.Bool("stack", false, "record the user stack of every event, as Go frames")
+	pid       = flag.Int("p", 0, "trace running process pid instead of running a command")
+	follow    = flag.Bool("follow", false, "also trace the processes started by the traced process")
+	tracefs   = flag.String("tracefs", debugfs.Top.Dir, "directory of the kernel tracing files")
+	format    = flag.String("format", "text", "output format, text for the kernel trace or jsonl for JSON Lines")
 	leaveOn   = flag.Bool("leavetrace", false, "leave tracing on")
 )
 
-var filter MultiFlag
+var filter, at, debugdir, selects, fetches, globalVars, impls MultiFlag
+
+var selectors []*godebug.Selector
 
 func init() {
 	flag.Var(&filter, "filter", "only trace functions matching regexp; can be set multiple times")
+	flag.Var(&selects, "select", "only trace functions matching selector; can be set multiple times")
+	flag.Var(&fetches, "arg", "fetch a parameter, a local variable at -at lines, or a field path like req.URL.Path where there is one; can be set multiple times")
+	flag.Var(&globalVars, "global", "fetch a package level variable or a field path like main.config.Addr in every Go probe; can be set multiple times")
+	flag.Var(&at, "at", "trace execution of source line file:line; can be set multiple times")
+	flag.Var(&impls, "impl", "trace the methods of every type implementing an interface like io.Writer, or one method like io.Writer.Write; can be set multiple times")
+	flag.Var(&debugdir, "debugdir", "look for separate debug info in dir; can be set multiple times")
 }
 
 // MultiFlag allows setting a value multiple times to collect a list,
@@ -68,109 +195,465 @@ func (m *MultiFlag) Set(val string) error {
 
 func Usage() {
 	fmt.Fprintf(os.Stderr, "usage: gotrace [options] command [args]\n")
+	fmt.Fprintf(os.Stderr, "       gotrace [options] -p pid\n")
+	fmt.Fprintf(os.Stderr, "       gotrace cleanup\n")
 	fmt.Fprintf(os.Stderr, "Flags:\n")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
 
 var (
-	out = os.Stderr
-	cmd *exec.Cmd
-	prg *godebug.Prog
-	uprobes []io.Reader
-	pipew *io.PipeWriter
-	done = make(chan bool)
+	out    = os.Stderr
+	cmd    *exec.Cmd
+	prg    *godebug.Prog
+	probes []*uprobes.Event
+	pipew  *io.PipeWriter
+	done   = make(chan bool) // closed when the events are all written
+
+	// implProbes are the -impl events, by name.
+	implProbes = make(map[string]implProbe)
+
+	// draining is set when recording stops, and the trace pipe is read
+	// until empty instead of waited on.
+	draining atomic.Bool
+
+	// session names the uprobe group and the tracing instance of this
+	// gotrace, inst.
+	session   = fmt.Sprintf("gotrace_%d", os.Getpid())
+	sess      *state
+	inst      *debugfs.Instance
+	tracePipe *os.File
+
+	// target is the traced process, started stopped or given by -p,
+	// or 0 if not known.
+	target int
+
+	// stopped is set while the command is stopped by startcmd, until
+	// release. Whichever of release and cleanup, which runs on signals
+	// and panics in other goroutines, clears it first lets the command
+	// go or kills it.
+	stopped atomic.Bool
+)
+
+// Tracing instances are created and removed by these, which tests
+// replace to imitate the kernel in a fake tracefs.
+var (
+	newInstance = func(name string) (*debugfs.Instance, error) {
+		return debugfs.Top.NewInstance(name)
+	}
+	removeInstance = (*debugfs.Instance).Remove
 )
 
+var cleanupOnce sync.Once
+
+// cleanup removes the probes and the tracing instance of the session.
+// It's called on every way out, and only does it once: at the end of
+// main, by fatal and fatalf, which gotrace exits with on errors, and
+// after panics, by the deferred cleanup of main or by cleanupPanic in
+// the other goroutines.
 func cleanup() {
 	if !*tracing {
 		return
 	}
-	log.Println("disabling tracing... (this might take a while)")
-	err := pipew.Close()
-	err = os.Truncate(debugfs.UprobesEvents, 0)
-	if *leaveOn {
-		log.Println("leaving tracing enabled")
+	cleanupOnce.Do(cleanup1)
+}
+
+// fatal cleans up then is like log.Fatal, which skips deferred calls.
+func fatal(v ...any) {
+	cleanup()
+	log.Fatal(v...)
+}
+
+// fatalf cleans up then is like log.Fatalf.
+func fatalf(format string, v ...any) {
+	cleanup()
+	log.Fatalf(format, v...)
+}
+
+// cleanupPanic cleans up after a panic, and lets it go on. Goroutines
+// other than main defer it, the deferred calls of main don't run on
+// their panics.
+func cleanupPanic() {
+	if r := recover(); r != nil {
+		cleanup()
+		panic(r)
+	}
+}
+
+func cleanup1() {
+	if stopped.Swap(false) {
+		// Never let go, the command would run untraced.
+		cmd.Process.Kill()
+	}
+	if pipew != nil {
+		pipew.Close()
+	}
+	if sess == nil {
+		return
+	}
+	log.Println("disabling tracing...")
+	if *leaveOn && inst != nil {
+		log.Printf("leaving tracing enabled in %s; gotrace cleanup disables it", inst.Dir)
+		sess.Leave = true
+		if err := sess.save(); err != nil {
+			log.Print(err)
+		}
 		return
 	}
-	err = debugfs.Disable(debugfs.UprobesEnable)
-	if err != nil {
-		log.Fatal(err)
+	if inst != nil {
+		if err := inst.Disable(debugfs.EventsEnable(session)); err != nil {
+			log.Print(err)
+		}
+		tracePipe.Close()
+	}
+	if err := sess.remove(); err != nil {
+		log.Print(err)
 	}
 }
 
 func flags() {
 	flag.Usage = Usage
 	flag.Parse()
-	if flag.NArg() == 0 {
+	if (flag.NArg() == 0) == (*pid == 0) {
 		flag.Usage()
 	}
-	if len(filter) == 0 {
+	if len(filter) == 0 && len(selects) == 0 && len(at) == 0 && len(impls) == 0 {
 		filter = append(filter, ".")
 	}
+	for _, s := range selects {
+		sel, err := godebug.ParseSelector(s)
+		if err != nil {
+			fatal(err)
+		}
+		selectors = append(selectors, sel)
+	}
+	if len(debugdir) > 0 {
+		godebug.DebugDirs = debugdir
+	}
+	debugfs.Top.Dir = *tracefs
+	if *format != "text" && *format != "jsonl" {
+		fatalf("bad -format %s: want text or jsonl", *format)
+	}
 	if *ofile != "" {
 		f, err := os.Create(*ofile)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 		out = f
 	}
 }
 
-func signals() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	go func() {
-		<-c
-		cleanup()
-	}()
-}
-
 func command() {
+	if *pid != 0 {
+		return
+	}
 	cmd = exec.Command(flag.Arg(0), flag.Args()[1:]...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 }
 
+// matches reports whether the function name, defined in file, matches
+// any of the filters or selectors. file is empty if unknown.
+func matches(name, file string) bool {
+	for _, sel := range selectors {
+		if sel.Match(name, file) {
+			return true
+		}
+	}
+	for _, regex := range filter {
+		matched, err := regexp.MatchString(regex, name)
+		if err != nil {
+			fatal(err)
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
 func findprobes() {
-	prg, err := godebug.NewProg(cmd)
+	target = *pid
+	var err error
+	if *pid != 0 {
+		prg, err = godebug.NewProgFromPID(*pid)
+	} else {
+		prg, err = godebug.NewProg(cmd)
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	if v := prg.GoVersion(); v != "" {
+		log.Printf("program built with %s for %s", v, prg.GOARCH())
+	}
+	if f := prg.DebugFile(); f != "" {
+		log.Printf("using debug info from %s", f)
+	}
+	if _, err := prg.GoidOffset(); err != nil {
+		log.Printf("not recording goroutine IDs: %v", err)
+	}
+	if _, err := prg.DWARF(); err != nil && len(fetches)+len(globalVars) > 0 {
+		fatalf("can't fetch %s: %v", strings.Join(append(fetches, globalVars...), ", "), err)
+	}
+	var globals uprobes.Args
+	for _, expr := range globalVars {
+		args, _, err := prg.GlobalArgs(expr)
+		if err != nil {
+			fatal(err)
+		}
+		globals = append(globals, args...)
 	}
 	i := 0
-	for _, fn := range prg.Funcs {
-		for _, regex := range filter {
-			matched, err := regexp.MatchString(regex, fn.Name)
+	// add adds ev, a probe of the Go program.
+	add := func(ev *uprobes.Event) {
+		ev.FetchArgs = append(ev.FetchArgs, globals...)
+		probes = append(probes, ev)
+		i++
+	}
+	names, err := prg.InlinedFuncs()
+	if err != nil {
+		log.Printf("not tracing inlined calls: %v", err)
+	}
+	inl := err == nil
+	inlined := func(name string) {
+		if !inl {
+			return
+		}
+		evs, err := godebug.InlineUprobes(prg, name)
+		if err != nil {
+			fatal(err)
+		}
+		for _, ev := range evs {
+			add(ev)
+		}
+	}
+	// fetch adds to ev the -arg expressions that args can read at the
+	// probe, described by where.
+	fetch := func(ev *uprobes.Event, where string, args func(expr string) (uprobes.Args, dwarf.Type, error)) {
+		for _, expr := range fetches {
+			a, _, err := args(expr)
+			if errors.Is(err, godebug.ErrNoVariable) {
+				continue
+			}
 			if err != nil {
-				log.Fatal(err)
+				log.Printf("%s: not fetching %v", where, err)
+				continue
 			}
-			if !matched {
+			ev.FetchArgs = append(ev.FetchArgs, a...)
+		}
+	}
+	skipped := make(map[string]int)
+	for _, fn := range prg.Funcs {
+		file, line, _ := prg.PCToLine(fn.Entry)
+		if !matches(fn.Name, file) {
+			continue
+		}
+		why := prg.Unsafe(&fn)
+		if *list {
+			if why != "" && !*unsafe {
+				fmt.Fprintf(out, "%s\t%s:%d\tskipped: %s\n", fn.Name, file, line, why)
+			} else {
+				fmt.Fprintf(out, "%s\t%s:%d\n", fn.Name, file, line)
+			}
+			continue
+		}
+		if why != "" && !*unsafe {
+			skipped[why]++
+			continue
+		}
+		ev := godebug.Uprobe(prg, &fn)
+		fetch(ev, fn.Name, func(expr string) (uprobes.Args, dwarf.Type, error) {
+			return prg.ExprArgs(&fn, expr)
+		})
+		add(ev)
+		if *traceRet {
+			add(godebug.UretProbe(prg, &fn))
+		}
+		inlined(fn.Name)
+	}
+	for _, name := range names {
+		if !matches(name, "") {
+			continue
+		}
+		if *list {
+			fmt.Fprintf(out, "%s\tinlined away\n", name)
+			continue
+		}
+		log.Printf("%s has been inlined away, tracing only its inline sites", name)
+		inlined(name)
+	}
+	for _, name := range impls {
+		ims, method, err := implementations(prg, name)
+		if err != nil {
+			fatal(err)
+		}
+		for _, im := range ims {
+			for _, fn := range im.Methods {
+				if method != "" && godebug.SplitName(fn.Name).Func != method {
+					continue
+				}
+				why := prg.Unsafe(fn)
+				if *list {
+					if why != "" && !*unsafe {
+						fmt.Fprintf(out, "%s\t%s\t%s\tskipped: %s\n", im.Iface, im.Type, fn.Name, why)
+					} else {
+						fmt.Fprintf(out, "%s\t%s\t%s\n", im.Iface, im.Type, fn.Name)
+					}
+					continue
+				}
+				if why != "" && !*unsafe {
+					skipped[why]++
+					continue
+				}
+				ip := implProbe{Func: fn.Name, Iface: im.Iface, Type: im.Type}
+				ev := godebug.ImplUprobe(prg, im, fn)
+				fetch(ev, fn.Name, func(expr string) (uprobes.Args, dwarf.Type, error) {
+					return prg.ExprArgs(fn, expr)
+				})
+				add(ev)
+				implProbes[ev.Name] = ip
+				if *traceRet {
+					ev := godebug.ImplUretProbe(prg, im, fn)
+					add(ev)
+					implProbes[ev.Name] = ip
+				}
+			}
+		}
+	}
+	if *traceC {
+		cfns, err := prg.CFuncs()
+		if err != nil {
+			fatal(err)
+		}
+		for _, fn := range cfns {
+			if !matches(fn.Name, "") {
+				continue
+			}
+			why := prg.CUnsafe(fn)
+			if *list {
+				if why != "" && !*unsafe {
+					fmt.Fprintf(out, "%s\t%s\tskipped: %s\n", fn.Name, fn.Path, why)
+				} else {
+					fmt.Fprintf(out, "%s\t%s\n", fn.Name, fn.Path)
+				}
 				continue
 			}
-			uprobes = append(uprobes, godebug.Uprobe(prg, &fn))
+			if why != "" && !*unsafe {
+				skipped[why]++
+				continue
+			}
+			probes = append(probes, godebug.CUprobe(prg, fn))
 			i++
 			if *traceRet {
-				uprobes = append(uprobes, godebug.UretProbe(prg, &fn))
+				probes = append(probes, godebug.CUretProbe(prg, fn))
 				i++
 			}
 		}
 	}
-	log.Printf("found %d probes", i)
+	for _, pos := range at {
+		n := strings.LastIndex(pos, ":")
+		if n < 0 {
+			fatalf("bad -at %s: want file:line", pos)
+		}
+		line, err := strconv.Atoi(pos[n+1:])
+		if err != nil {
+			fatalf("bad -at %s: %v", pos, err)
+		}
+		evs, err := godebug.LineUprobes(prg, pos[:n], line)
+		if err != nil {
+			fatal(err)
+		}
+		for _, ev := range evs {
+			pc := prg.PC(ev.Offset)
+			fetch(ev, fmt.Sprintf("%s (%#x)", pos, pc), func(expr string) (uprobes.Args, dwarf.Type, error) {
+				return prg.LocalArgs(pc, expr)
+			})
+			add(ev)
+		}
+	}
+	if !*list {
+		logSkipped(skipped)
+		log.Printf("found %d probes", i)
+	}
+	if *namesFile != "" {
+		f, err := os.Create(*namesFile)
+		if err != nil {
+			fatal(err)
+		}
+		if _, err := prg.Names.WriteTo(f); err != nil {
+			fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+// implementations returns the implementations of the interface name,
+// or of the interface of the method name, and the method.
+func implementations(prg *godebug.Prog, name string) (ims []godebug.Impl, method string, err error) {
+	ims, err = prg.Implementations(name)
+	if err != nil || len(ims) > 0 {
+		return ims, "", err
+	}
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		ims, err = prg.Implementations(name[:i])
+		if err != nil || len(ims) > 0 {
+			return ims, name[i+1:], err
+		}
+	}
+	return nil, "", fmt.Errorf("no types implementing %s", name)
+}
+
+// logSkipped logs how many functions were skipped for being unsafe to
+// probe, by reason.
+func logSkipped(skipped map[string]int) {
+	if len(skipped) == 0 {
+		return
+	}
+	var n int
+	var whys []string
+	for why, k := range skipped {
+		n += k
+		whys = append(whys, why)
+	}
+	sort.Slice(whys, func(i, j int) bool { return skipped[whys[i]] > skipped[whys[j]] })
+	for i, why := range whys {
+		whys[i] = fmt.Sprintf("%d %s", skipped[why], why)
+	}
+	log.Printf("skipped %d functions unsafe to probe (%s); use -list to see them, -unsafe to trace them", n, strings.Join(whys, ", "))
 }
 
 func writeprobes() {
 	f := out
 	var err error
 	if *tracing {
-		f, err = os.Create(debugfs.UprobesEvents)
+		// Other users' probes are left alone.
+		f, err = os.OpenFile(debugfs.Top.Path(debugfs.UprobeEventsFile), os.O_WRONLY|os.O_APPEND, 0)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	}
-	_, err = io.Copy(f, io.MultiReader(uprobes...))
+	rs := make([]io.Reader, len(probes))
+	events := make([]string, len(probes))
+	for i, ev := range probes {
+		if *tracing {
+			ev.Group = session
+		}
+		rs[i] = ev
+		events[i] = ev.Group + "/" + ev.Name
+	}
+	if *tracing {
+		// Recorded first, what's installed is never left unrecorded.
+		sess = newState(events)
+		if err := sess.save(); err != nil {
+			log.Printf("can't save session state: %v", err)
+		}
+	}
+	_, err = io.Copy(f, io.MultiReader(rs...))
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	if *tracing {
 		f.Close()
@@ -181,52 +664,358 @@ func trace() {
 	if !*tracing {
 		return
 	}
-	err := os.Truncate(debugfs.Trace, 0)
+	var err error
+	inst, err = newInstance(session)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
-	tracePipe, err := os.Open(debugfs.TracePipe)
+	// Reads of a non-blocking trace pipe end when it's closed, which
+	// it must be for the instance to be removed.
+	tracePipe, err = os.OpenFile(inst.Path(debugfs.TracePipeFile), os.O_RDONLY|syscall.O_NONBLOCK, 0)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	if *stacks {
+		// The kernel resolves addresses to offsets in the mappings
+		// of files, which don't depend on where the program is
+		// loaded, while it's running.
+		for _, opt := range []string{"userstacktrace", "sym-userobj"} {
+			if err := inst.SetOption(opt); err != nil {
+				fatal(err)
+			}
+		}
+	}
+	if target != 0 {
+		if err := followPID(target); err != nil {
+			fatal(err)
+		}
+	} else if *format == "jsonl" {
+		// For the pid of records.
+		if err := inst.SetOption("record-tgid"); err != nil {
+			fatal(err)
+		}
 	}
-	err = debugfs.Enable(debugfs.UprobesEnable)
+	err = inst.Enable(debugfs.EventsEnable(session))
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	log.Println("tracing...")
 	r, w := io.Pipe()
 	pipew = w
+	go readTrace(w)
+	var events io.Reader = r
+	if target != 0 && !*follow {
+		events = onlyProcess(r, target)
+	}
+	if *stacks {
+		r, w := io.Pipe()
+		go func(events io.Reader) {
+			defer cleanupPanic()
+			w.CloseWithError(symbolizer().Copy(w, events))
+		}(events)
+		events = r
+	}
 	go func() {
-		io.Copy(w, tracePipe)
-	}()
-	go func() {
-		io.Copy(out, r)
+		defer cleanupPanic()
+		var err error
+		if *format == "jsonl" {
+			err = writeJSONL(out, events, probes, prg.Names, implProbes)
+		} else {
+			_, err = io.Copy(out, events)
+		}
+		if err != nil {
+			// The events would be lost, tracing on is pointless.
+			fatalf("writing events: %v", err)
+		}
 		close(done)
 	}()
 }
 
-func runcmd() {
-	if !*run {
+// drainTime bounds the time spent writing the events left in the trace
+// buffer when tracing stops.
+const drainTime = 500 * time.Millisecond
+
+// readTrace copies the trace pipe to w, until it's empty once draining.
+func readTrace(w *io.PipeWriter) {
+	defer cleanupPanic()
+	rc, err := tracePipe.SyscallConn()
+	if err != nil {
+		w.CloseWithError(err)
 		return
 	}
-	err := cmd.Run()
-	if err != nil {
+	buf := make([]byte, 64<<10)
+	for {
+		var n int
+		var rerr error
+		err := rc.Read(func(fd uintptr) bool {
+			n, rerr = syscall.Read(int(fd), buf)
+			// An empty pipe is waited on, unless draining.
+			return rerr != syscall.EAGAIN || draining.Load()
+		})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Woken up by stopTrace, read what's left.
+			tracePipe.SetReadDeadline(time.Time{})
+			continue
+		}
+		if err == nil {
+			err = rerr
+		}
+		if err == syscall.EAGAIN || err == nil && n == 0 {
+			// Empty, or at the end of a file standing in for the
+			// trace pipe.
+			w.Close()
+			return
+		}
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// stopTrace stops recording events, waits at most drainTime for those
+// already recorded to be written, and cleans up.
+func stopTrace() {
+	if inst == nil {
 		cleanup()
-		log.Fatal(err)
+		return
+	}
+	if !*leaveOn {
+		// Turning the buffer off is immediate, while disabling the
+		// events takes the kernel a while for every probe.
+		if err := inst.Disable(debugfs.TracingOnFile); err != nil {
+			log.Print(err)
+		}
+	}
+	draining.Store(true)
+	tracePipe.SetReadDeadline(time.Now())
+	select {
+	case <-done:
+	case <-time.After(drainTime):
+		log.Print("events left unwritten")
 	}
 	cleanup()
 }
 
+// symbolizer returns a Symbolizer of the stacks of the processes running
+// the program, which are looked up while they are alive.
+func symbolizer() *godebug.Symbolizer {
+	s := godebug.NewSymbolizer(prg)
+	bases := make(map[int]uint64)
+	s.Base = func(pid int) (uint64, bool) {
+		base, ok := bases[pid]
+		if !ok {
+			var err error
+			if base, err = prg.LoadBase(pid); err != nil {
+				return 0, false
+			}
+			bases[pid] = base
+		}
+		return base, true
+	}
+	return s
+}
+
+// followPID restricts tracing to the threads of process pid, and to the
+// threads and processes they start. It also records the process of
+// every event, for onlyProcess.
+func followPID(pid int) error {
+	if err := inst.Clear(debugfs.SetEventPidFile); err != nil {
+		return err
+	}
+	for _, opt := range []string{"event-fork", "record-tgid"} {
+		if err := inst.SetOption(opt); err != nil {
+			return err
+		}
+	}
+	// Threads started while the list is being written are not
+	// followed, the next pass adds them.
+	seen := make(map[string]bool)
+	for {
+		tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+		if err != nil {
+			return err
+		}
+		var tids []string
+		for _, t := range tasks {
+			if !seen[t.Name()] {
+				seen[t.Name()] = true
+				tids = append(tids, t.Name())
+			}
+		}
+		if len(tids) == 0 {
+			return nil
+		}
+		if err := inst.Append(debugfs.SetEventPidFile, strings.Join(tids, " ")); err != nil {
+			return err
+		}
+	}
+}
+
+// tgidHeader matches the header of an event with its process, as in
+//
+//	prog-1235    (   1234) [001]
+var tgidHeader = regexp.MustCompile(`^\s*.*-[0-9]+\s+\(\s*([0-9]+|-+)\)\s+\[[0-9]+\]`)
+
+// onlyProcess returns the events read from r that happened in process
+// pid, as opposed to the processes it started. Events of unknown
+// processes are kept.
+func onlyProcess(r io.Reader, pid int) io.Reader {
+	pr, pw := io.Pipe()
+	tgid := strconv.Itoa(pid)
+	go func() {
+		defer cleanupPanic()
+		sc := bufio.NewScanner(r)
+		keep := true
+		for sc.Scan() {
+			line := sc.Text()
+			// Lines without a header, like stack entries, belong to
+			// the previous event.
+			if m := tgidHeader.FindStringSubmatch(line); m != nil {
+				keep = m[1] == tgid || strings.HasPrefix(m[1], "-")
+			}
+			if keep {
+				if _, err := fmt.Fprintln(pw, line); err != nil {
+					return
+				}
+			}
+		}
+		pw.CloseWithError(sc.Err())
+	}()
+	return pr
+}
+
+// watch returns when process pid exits.
+func watch(pid int) {
+	for alive(pid) {
+		time.Sleep(250 * time.Millisecond)
+	}
+	log.Printf("process %d exited", pid)
+}
+
+// alive reports whether process pid is running.
+func alive(pid int) bool {
+	fields, err := procStat(pid)
+	return err == nil && running(fields)
+}
+
+// startcmd starts the command, stopped at its first instruction until
+// release is called, so that tracing can be restricted to it first.
+func startcmd() {
+	if !*run || *pid != 0 {
+		return
+	}
+	if !*tracing {
+		if err := cmd.Start(); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	// A process started as traced stops after exec. Only the thread
+	// that started it can let it go.
+	runtime.LockOSThread()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Ptrace: true}
+	if err := cmd.Start(); err != nil {
+		fatal(err)
+	}
+	stopped.Store(true)
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(cmd.Process.Pid, &ws, 0, nil); err != nil {
+		fatalf("%s didn't start: %v", cmd.Path, err)
+	}
+	if !ws.Stopped() {
+		stopped.Store(false)
+		fatalf("%s didn't start: %s", cmd.Path, waitStatus(ws))
+	}
+	target = cmd.Process.Pid
+}
+
+// waitStatus describes how a process that didn't stop ended.
+func waitStatus(ws syscall.WaitStatus) string {
+	switch {
+	case ws.Exited():
+		return fmt.Sprintf("exit status %d", ws.ExitStatus())
+	case ws.Signaled():
+		return fmt.Sprintf("signal: %v", ws.Signal())
+	}
+	return fmt.Sprintf("wait status %#x", uint32(ws))
+}
+
+// release lets the command started by startcmd run.
+func release() {
+	if cmd == nil || cmd.Process == nil || target == 0 {
+		return
+	}
+	defer runtime.UnlockOSThread()
+	if !stopped.CompareAndSwap(true, false) {
+		// Killed by cleanup.
+		return
+	}
+	if err := syscall.PtraceDetach(target); err != nil {
+		cmd.Process.Kill()
+		fatal(err)
+	}
+}
+
+// wait waits for the command, or the process given by -p, to exit, or
+// for ctx to be done, by a signal. It returns the error of the command.
+func wait(ctx context.Context) error {
+	exited := make(chan error, 1)
+	switch {
+	case !*tracing && (*pid != 0 || !*run):
+		// Only printing the probes.
+		return nil
+	case *pid != 0:
+		go func() {
+			defer cleanupPanic()
+			watch(*pid)
+			exited <- nil
+		}()
+	case *run:
+		go func() {
+			defer cleanupPanic()
+			exited <- cmd.Wait()
+		}()
+	}
+	select {
+	case err := <-exited:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
 func main() {
 	defer cleanup()
+	// Only gotrace cleanup, the command named cleanup is traced when
+	// given with flags or as a path.
+	if len(os.Args) == 2 && os.Args[1] == "cleanup" {
+		cleanStale(true)
+		return
+	}
 	flags()
-	signals()
 	command()
 	findprobes()
+	if *list {
+		os.Exit(0)
+	}
+	if *tracing {
+		cleanStale(false)
+	}
+	// From now on, interrupting gotrace stops tracing. Interrupting it
+	// again kills it, leaving the cleanup to the next gotrace.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	writeprobes()
+	startcmd()
 	trace()
-	runcmd()
-	if *tracing {
-		<-done
+	release()
+	err := wait(ctx)
+	stop()
+	stopTrace()
+	if err != nil {
+		fatal(err)
 	}
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"mgk.ro/debugfs"
+)
+
+// The test binary runs gotrace, as a process of its own, when
+// GOTRACE_TEST_MAIN is set, with a fake kernel.
+func TestMain(m *testing.M) {
+	if os.Getenv("GOTRACE_TEST_MAIN") != "" {
+		fakeKernel()
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeKernel makes gotrace create and remove the tracing instances of a
+// fake tracefs with their files, as the kernel does, and keep its state
+// in GOTRACE_TEST_STATE.
+func fakeKernel() {
+	stateDir = os.Getenv("GOTRACE_TEST_STATE")
+	newInstance = func(name string) (*debugfs.Instance, error) {
+		inst, err := debugfs.Top.NewInstance(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range []string{
+			debugfs.TraceFile, debugfs.TracePipeFile, debugfs.TraceOptionsFile,
+			debugfs.SetEventPidFile, debugfs.TracingOnFile, debugfs.EventsEnable(name),
+		} {
+			path := inst.Path(file)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				return nil, err
+			}
+		}
+		return inst, nil
+	}
+	removeInstance = func(inst *debugfs.Instance) error {
+		return os.RemoveAll(inst.Dir)
+	}
+}
+
+// A traceSession is a gotrace running with a fake tracefs.
+type traceSession struct {
+	t      *testing.T
+	cmd    *exec.Cmd
+	group  string
+	stderr bytes.Buffer
+}
+
+// startSession starts gotrace, tracing fmt.Fprintf in the test binary
+// without running it, and waits until it has enabled its events.
+func startSession(t *testing.T, tracefs, state string) *traceSession {
+	s := &traceSession{t: t}
+	s.cmd = exec.Command(os.Args[0], "-tracefs="+tracefs, "-run=false", `-filter=^fmt\.Fprintf$`, os.Args[0])
+	s.cmd.Env = append(os.Environ(), "GOTRACE_TEST_MAIN=1", "GOTRACE_TEST_STATE="+state)
+	s.cmd.Stderr = &s.stderr
+	if err := s.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if s.cmd.ProcessState == nil {
+			s.cmd.Process.Kill()
+			s.cmd.Wait()
+		}
+	})
+	s.group = fmt.Sprintf("gotrace_%d", s.cmd.Process.Pid)
+	enable := filepath.Join(tracefs, "instances", s.group, debugfs.EventsEnable(s.group))
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		if b, _ := os.ReadFile(enable); string(b) == "1\n" {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s didn't enable its events:\n%s", s.group, s.stderr.Bytes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stop interrupts gotrace, which cleans up.
+func (s *traceSession) stop() {
+	if err := s.cmd.Process.Signal(os.Interrupt); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := s.cmd.Wait(); err != nil {
+		s.t.Fatalf("%s: %v:\n%s", s.group, err, s.stderr.Bytes())
+	}
+}
+
+// uprobeEventLines returns the lines written to the fake uprobe_events,
+// probes and removals alike, sorted.
+func uprobeEventLines(t *testing.T, tracefs string) []string {
+	b, err := os.ReadFile(filepath.Join(tracefs, debugfs.UprobeEventsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		// p:group/name path:offset args
+		ev, _, _ := strings.Cut(sc.Text(), " ")
+		lines = append(lines, ev)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	tracefs, state := t.TempDir(), t.TempDir()
+	const foreign = "p:other/probe /bin/true:0x1000\n"
+	if err := os.WriteFile(filepath.Join(tracefs, debugfs.UprobeEventsFile), []byte(foreign), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(tracefs, "instances"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	a := startSession(t, tracefs, state)
+	b := startSession(t, tracefs, state)
+	probes := func(s *traceSession) []string {
+		return []string{"p:" + s.group + "/fmt_Fprintf", "r:" + s.group + "/fmt_Fprintf_ret"}
+	}
+	removals := func(s *traceSession) []string {
+		return []string{"-:" + s.group + "/fmt_Fprintf", "-:" + s.group + "/fmt_Fprintf_ret"}
+	}
+	check := func(when string, want ...[]string) {
+		t.Helper()
+		var all []string
+		for _, w := range want {
+			all = append(all, w...)
+		}
+		all = append(all, "p:other/probe")
+		sort.Strings(all)
+		if got := uprobeEventLines(t, tracefs); strings.Join(got, "\n") != strings.Join(all, "\n") {
+			t.Errorf("%s, uprobe_events has\n\t%s\nwant\n\t%s", when, strings.Join(got, "\n\t"), strings.Join(all, "\n\t"))
+		}
+	}
+	instance := func(s *traceSession) string {
+		return filepath.Join(tracefs, "instances", s.group)
+	}
+	stateFile := func(s *traceSession) string {
+		return filepath.Join(state, s.group+".json")
+	}
+
+	check("with both sessions running", probes(a), probes(b))
+	for _, s := range []*traceSession{a, b} {
+		if !exists(instance(s)) || !exists(stateFile(s)) {
+			t.Errorf("%s has no instance or no state file", s.group)
+		}
+	}
+
+	a.stop()
+	check("after the first session", probes(a), probes(b), removals(a))
+	if exists(instance(a)) || exists(stateFile(a)) {
+		t.Errorf("%s left its instance or its state file", a.group)
+	}
+	if !exists(instance(b)) || !exists(stateFile(b)) {
+		t.Errorf("%s removed the instance or the state file of %s", a.group, b.group)
+	}
+
+	b.stop()
+	check("after both sessions", probes(a), probes(b), removals(a), removals(b))
+	if exists(instance(b)) || exists(stateFile(b)) {
+		t.Errorf("%s left its instance or its state file", b.group)
+	}
+}
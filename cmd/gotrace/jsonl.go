@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"mgk.ro/godebug"
+	"mgk.ro/uprobes"
+)
+
+// A record is an event, as written by -format=jsonl.
+type record struct {
+	Timestamp json.Number    `json:"timestamp"`
+	CPU       int            `json:"cpu"`
+	PID       int            `json:"pid,omitempty"`
+	TID       int            `json:"tid"`
+	Goid      *uint64        `json:"goid,omitempty"`
+	Kind      string         `json:"kind"` // entry, return, inline or line
+	Function  string         `json:"function,omitempty"`
+	Interface string         `json:"interface,omitempty"` // of -impl events, the interface called through
+	Type      string         `json:"type,omitempty"`      // of -impl events, the dynamic type
+	Line      string         `json:"line,omitempty"`      // of line events, as given to -at
+	Event     string         `json:"event"`
+	Args      map[string]any `json:"args,omitempty"`
+	Results   map[string]any `json:"results,omitempty"`
+	Stack     []string       `json:"stack,omitempty"`
+	Truncated bool           `json:"truncated,omitempty"` // some arguments are missing
+}
+
+// An implProbe is what an -impl event traces: Func, the method of Type
+// called through the interface Iface.
+type implProbe struct {
+	Func, Iface, Type string
+}
+
+// A lostRecord reports events the kernel dropped, the trace buffer of
+// cpu being full.
+type lostRecord struct {
+	CPU  int    `json:"cpu"`
+	Kind string `json:"kind"` // lost
+	Lost int    `json:"lost"`
+}
+
+var (
+	// The header of an event, as in
+	//	prog-1235    (   1234) [001] DBZff  3241.599842: main_handle: rest
+	eventLine = regexp.MustCompile(`^\s*.*-([0-9]+)\s+(?:\(\s*([0-9]+|-+)\)\s+)?\[([0-9]+)\]\s+(?:\S+\s+)??([0-9]+\.[0-9]+):\s+(\w+):\s?(.*)$`)
+	lostLine  = regexp.MustCompile(`^CPU:([0-9]+) \[LOST ([0-9]+) EVENTS\]`)
+
+	// The probe address of events, as in (0x49a620) or
+	// (0x49a7c5 <- 0x49a620) for return probes.
+	probeAddr = regexp.MustCompile(`^\(0x[0-9a-f]+( <- 0x[0-9a-f]+)?\)\s*`)
+
+	// The event name of line probes is a source position.
+	linePos = regexp.MustCompile(`:[0-9]+$`)
+)
+
+// writeJSONL writes the events of the kernel trace read from r to w as
+// JSON Lines, one record per event. Only the events of the probes in
+// probes and lost events are written. Stack entries, as written by the
+// Symbolizer, go with the event before them. The events of impls, by
+// event name, are written as calls of the concrete method.
+func writeJSONL(w io.Writer, r io.Reader, probes []*uprobes.Event, names *godebug.Mangler, impls map[string]implProbe) error {
+	evs := make(map[string]*uprobes.Event)
+	for _, ev := range probes {
+		evs[ev.Name] = ev
+	}
+	enc := json.NewEncoder(w)
+	var pending *record // waiting for its stack
+	flush := func() error {
+		if pending == nil {
+			return nil
+		}
+		rec := pending
+		pending = nil
+		return enc.Encode(rec)
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	var line string
+	unread := false // line is to be read again
+	scan := func() bool {
+		if unread {
+			unread = false
+			return true
+		}
+		if !sc.Scan() {
+			return false
+		}
+		line = sc.Text()
+		return true
+	}
+	for scan() {
+		if pending != nil && strings.HasSuffix(line, ": <user stack trace>") {
+			continue
+		}
+		if pending != nil && strings.HasPrefix(line, " => ") {
+			pending.Stack = append(pending.Stack, strings.TrimPrefix(line, " => "))
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if m := lostLine.FindStringSubmatch(line); m != nil {
+			cpu, _ := strconv.Atoi(m[1])
+			n, _ := strconv.Atoi(m[2])
+			if err := enc.Encode(lostRecord{CPU: cpu, Kind: "lost", Lost: n}); err != nil {
+				return err
+			}
+			continue
+		}
+		m := eventLine.FindStringSubmatch(line)
+		if m == nil || evs[m[5]] == nil {
+			continue
+		}
+		rec := &record{Timestamp: json.Number(m[4]), Event: m[5]}
+		rec.TID, _ = strconv.Atoi(m[1])
+		rec.PID, _ = strconv.Atoi(m[2])
+		rec.CPU, _ = strconv.Atoi(m[3])
+		rec.Kind, rec.Function = "entry", m[5]
+		if k, ok := names.Demangle(m[5]); ok {
+			switch {
+			case k.Suffix == "_ret":
+				rec.Kind = "return"
+			case strings.HasPrefix(k.Suffix, "_inl"):
+				rec.Kind = "inline"
+			case linePos.MatchString(k.Symbol):
+				rec.Kind = "line"
+			}
+			rec.Function = k.Symbol
+		}
+		if rec.Kind == "line" {
+			rec.Line, rec.Function = rec.Function, ""
+		}
+		if im, ok := impls[m[5]]; ok {
+			rec.Function, rec.Interface, rec.Type = im.Func, im.Iface, im.Type
+		}
+		// The kernel prints the chars of strings as they are, so
+		// newlines in strings go on with the event on the next line,
+		// which starts with the quote closing the newline.
+		args := m[6]
+		for unterminated(args) {
+			if !scan() {
+				rec.Truncated = true
+				break
+			}
+			if !strings.HasPrefix(line, "'") {
+				rec.Truncated = true
+				unread = true
+				break
+			}
+			args += "\n" + line
+		}
+		decodeArgs(rec, evs[m[5]], args)
+		pending = rec
+		if !*stacks {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return sc.Err()
+}
+
+// decodeArgs sets the goroutine, the arguments and the results of rec
+// from s, the arguments of an event of ev as printed by the kernel.
+// Values that can't be read, like strings at bad addresses, are null.
+func decodeArgs(rec *record, ev *uprobes.Event, s string) {
+	s = probeAddr.ReplaceAllString(s, "")
+	chars := make(map[string][]byte) // of string contents, by expression
+	for _, a := range ev.FetchArgs {
+		prefix := a.Name + "="
+		if !strings.HasPrefix(s, prefix) {
+			// Not the event we thought, or a value we can't parse.
+			return
+		}
+		s = s[len(prefix):]
+		var v any
+		switch {
+		case a.Type == uprobes.TypeChar && a.Len > 0:
+			var b []byte
+			var ok bool
+			b, s, ok = charArray(s)
+			if ok {
+				chars[a.Expr] = b
+				v = string(bytes.TrimRight(b, "\x00"))
+			}
+		default:
+			var tok string
+			tok, s, _ = strings.Cut(s, " ")
+			v = number(tok, isSigned(a.Type))
+		}
+		s = strings.TrimLeft(s, " ")
+		if a.Name == "goid" {
+			if n, ok := v.(uint64); ok {
+				rec.Goid = &n
+			}
+			continue
+		}
+		if a.Expr == "" {
+			continue
+		}
+		// Strings are cut to their length, which comes next.
+		if expr, ok := strings.CutPrefix(a.Expr, "len("); ok {
+			expr = strings.TrimSuffix(expr, ")")
+			if b, ok := chars[expr]; ok {
+				if n, ok := v.(int64); ok && 0 <= n && n < int64(len(b)) {
+					b = b[:n]
+				}
+				set(rec, a.Result, expr, string(b))
+			}
+		}
+		set(rec, a.Result, a.Expr, v)
+	}
+}
+
+// set sets the argument, or the result, expr of rec to v.
+func set(rec *record, result bool, expr string, v any) {
+	m := &rec.Args
+	if result {
+		m = &rec.Results
+	}
+	if *m == nil {
+		*m = make(map[string]any)
+	}
+	(*m)[expr] = v
+}
+
+// charArray reads a char array as printed by the kernel, like
+// {'a','b'}, from the start of s and returns it and the rest of s.
+func charArray(s string) ([]byte, string, bool) {
+	if strings.HasPrefix(s, "{") {
+		var b []byte
+		for i := 1; i+3 < len(s) && s[i] == '\'' && s[i+2] == '\''; i += 4 {
+			b = append(b, s[i+1])
+			if s[i+3] == '}' {
+				return b, s[i+4:], true
+			}
+			if s[i+3] != ',' {
+				break
+			}
+		}
+	}
+	// Like (fault).
+	_, rest, _ := strings.Cut(s, " ")
+	return nil, rest, false
+}
+
+// unterminated reports whether s, the arguments of an event, ends with
+// the quote opening a char of a char array, that is before a newline.
+func unterminated(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !strings.HasPrefix(s[i:], "={'") {
+			continue
+		}
+		// Skip the chars, which can be anything, like '{' or '='.
+		for i += 2; i < len(s) && s[i] == '\''; i += 4 {
+			if i+1 == len(s) {
+				return true
+			}
+			if i+3 >= len(s) || s[i+2] != '\'' || s[i+3] != ',' {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// number returns the number printed as s, or nil.
+func number(s string, signed bool) any {
+	if signed {
+		if n, err := strconv.ParseInt(s, 0, 64); err == nil {
+			return n
+		}
+		return nil
+	}
+	if n, err := strconv.ParseUint(s, 0, 64); err == nil {
+		return n
+	}
+	return nil
+}
+
+func isSigned(t uprobes.Type) bool {
+	switch t {
+	case uprobes.TypeS8, uprobes.TypeS16, uprobes.TypeS32, uprobes.TypeS64:
+		return true
+	}
+	return false
+}
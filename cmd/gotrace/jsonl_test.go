@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mgk.ro/godebug"
+	"mgk.ro/uprobes"
+)
+
+func TestWriteJSONL(t *testing.T) {
+	names := godebug.NewMangler()
+	name := names.Name("io.Writer.Write(*os.File)", "")
+	ev := uprobes.NewEvent(name, "/bin/prog", 0x9a620)
+	ev.FetchArgs = uprobes.Args{
+		{Name: "p", Type: uprobes.TypeChar, Len: 4, Expr: "p"},
+		{Name: "p_len", Type: uprobes.TypeS64, Expr: "len(p)"},
+		{Name: "goid", Type: uprobes.TypeU64},
+	}
+	impls := map[string]implProbe{
+		name: {Func: "os.(*File).Write", Iface: "io.Writer", Type: "*os.File"},
+	}
+	header := "prog-1235    (   1234) [001] DBZff  3241.599842: " + name + ": (0x49a620) "
+	trace := strings.Join([]string{
+		// A newline in p goes on with the event on the next line.
+		header + "p={'a','",
+		"','b','c'} p_len=3 goid=7",
+		// The rest of this one is lost.
+		header + "p={'a','",
+		header + "p={'x','y','z','w'} p_len=2 goid=8",
+	}, "\n") + "\n"
+
+	var out bytes.Buffer
+	if err := writeJSONL(&out, strings.NewReader(trace), []*uprobes.Event{ev}, names, impls); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]any
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var rec map[string]any
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, rec)
+	}
+	record := func(goid any, args map[string]any, truncated bool) map[string]any {
+		rec := map[string]any{
+			"timestamp": 3241.599842,
+			"cpu":       1.0,
+			"pid":       1234.0,
+			"tid":       1235.0,
+			"kind":      "entry",
+			"function":  "os.(*File).Write",
+			"interface": "io.Writer",
+			"type":      "*os.File",
+			"event":     name,
+		}
+		if goid != nil {
+			rec["goid"] = goid
+		}
+		if args != nil {
+			rec["args"] = args
+		}
+		if truncated {
+			rec["truncated"] = true
+		}
+		return rec
+	}
+	want := []map[string]any{
+		record(7.0, map[string]any{"p": "a\nb", "len(p)": 3.0}, false),
+		record(nil, map[string]any{"p": nil}, true),
+		record(8.0, map[string]any{"p": "xy", "len(p)": 2.0}, false),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n\t%v\nwant\n\t%v", got, want)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"mgk.ro/debugfs"
+)
+
+// stateDir holds a state file for every session, so that what the
+// sessions that died without cleaning up installed can be found and
+// removed later.
+var stateDir = "/run/gotrace"
+
+// A state describes what a session installs.
+type state struct {
+	PID     int
+	Start   uint64 // start time of process PID, telling it from later ones
+	Tracefs string
+	Group   string   // uprobe group, and name of the tracing instance
+	Events  []string // uprobe events, as group/name
+	Leave   bool     // tracing was left on with -leavetrace
+}
+
+// newState returns the state of this session, which installs events.
+func newState(events []string) *state {
+	st := &state{
+		PID:     os.Getpid(),
+		Tracefs: debugfs.Top.Dir,
+		Group:   session,
+		Events:  events,
+	}
+	if fields, err := procStat(st.PID); err == nil {
+		st.Start = startTime(fields)
+	}
+	return st
+}
+
+func (st *state) path() string {
+	return filepath.Join(stateDir, st.Group+".json")
+}
+
+// save writes the state file, atomically so that it's never seen half
+// written.
+func (st *state) save() error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := st.path() + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path())
+}
+
+// stale reports whether the session is gone, and didn't clean up.
+func (st *state) stale() bool {
+	fields, err := procStat(st.PID)
+	if err != nil || !running(fields) {
+		return true
+	}
+	return st.Start != 0 && startTime(fields) != st.Start
+}
+
+// remove removes the tracing instance and the events of the session,
+// then its state file. Those already removed are skipped. The state file
+// is kept if anything is left, for another try.
+func (st *state) remove() error {
+	var errs []error
+	inst := &debugfs.Instance{Dir: filepath.Join(st.Tracefs, "instances", st.Group)}
+	if _, err := os.Stat(inst.Dir); err == nil {
+		// Events can't be removed while enabled in any instance.
+		inst.Disable(debugfs.EventsEnable(st.Group))
+		if err := removeInstance(inst); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	top := &debugfs.Instance{Dir: st.Tracefs}
+	installed, err := uprobeEvents(top)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	// All the events are removed in one write, thousands of writes
+	// add up.
+	var b strings.Builder
+	for _, ev := range st.Events {
+		if installed[ev] {
+			fmt.Fprintf(&b, "-:%s\n", ev)
+		}
+	}
+	if b.Len() > 0 && top.Append(debugfs.UprobeEventsFile, strings.TrimSuffix(b.String(), "\n")) != nil {
+		// The kernel stops at the first line it can't handle. The
+		// events left are removed one at a time, to know which fail.
+		installed, err := uprobeEvents(top)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, ev := range st.Events {
+			if !installed[ev] {
+				continue
+			}
+			if err := top.Append(debugfs.UprobeEventsFile, "-:"+ev); err != nil {
+				errs = append(errs, fmt.Errorf("removing %s: %v", ev, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if err := os.Remove(st.path()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// uprobeEvents returns the uprobe events installed in the kernel, as
+// group/name.
+func uprobeEvents(top *debugfs.Instance) (map[string]bool, error) {
+	b, err := os.ReadFile(top.Path(debugfs.UprobeEventsFile))
+	if err != nil {
+		return nil, err
+	}
+	evs := make(map[string]bool)
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		// p:group/name path:offset args
+		ev, _, _ := strings.Cut(sc.Text(), " ")
+		if _, name, ok := strings.Cut(ev, ":"); ok {
+			evs[name] = true
+		}
+	}
+	return evs, sc.Err()
+}
+
+// cleanStale removes what the stale sessions installed, and if all is
+// set, what the sessions that left tracing on installed.
+func cleanStale(all bool) {
+	files, err := filepath.Glob(filepath.Join(stateDir, "*.json"))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		var st state
+		if err := json.Unmarshal(b, &st); err != nil {
+			log.Printf("%s: %v", file, err)
+			continue
+		}
+		if st.path() != file || !st.stale() || st.Leave && !all {
+			continue
+		}
+		if err := st.remove(); err != nil {
+			log.Printf("can't clean up session %s: %v", st.Group, err)
+			continue
+		}
+		log.Printf("cleaned up session %s", st.Group)
+	}
+}
+
+// procStat returns the fields of /proc/pid/stat after the command name,
+// the state first.
+func procStat(pid int) ([]string, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// 1234 (comm) S ..., where comm can contain anything.
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return nil, fmt.Errorf("bad /proc/%d/stat", pid)
+	}
+	return strings.Fields(string(b[i+1:])), nil
+}
+
+// running reports whether the process is running, from its stat fields.
+// Processes that exited but haven't been waited for by their parent are
+// zombies, not running.
+func running(fields []string) bool {
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
+
+// startTime returns the start time of the process, from its stat fields.
+func startTime(fields []string) uint64 {
+	if len(fields) < 20 {
+		return 0
+	}
+	t, _ := strconv.ParseUint(fields[19], 10, 64)
+	return t
+}
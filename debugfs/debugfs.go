@@ -1,36 +1,137 @@
 /*
 Package debugfs implements helper functions for accessing the Linux
-debugfs (/sys/kernel/debug).
+kernel tracing files, in debugfs (/sys/kernel/debug/tracing) or tracefs.
+
+The tracing files are grouped in instances, directories with their own
+trace buffer, event switches and options. The top level directory is
+the instance the kernel traces into by default; the others are created
+under its instances directory, and don't disturb its users or each
+other. Probes, like those in uprobe_events, are shared by all instances.
 */
 package debugfs // import "mgk.ro/debugfs"
 
 import (
 	"os"
+	"path/filepath"
 )
 
+// Tracing files, relative to the directory of an instance.
 const (
-	UprobesEvents = "/sys/kernel/debug/tracing/uprobe_events"
-	UprobesEnable = "/sys/kernel/debug/tracing/events/uprobes/enable"
-	Trace         = "/sys/kernel/debug/tracing/trace"
-	TracePipe     = "/sys/kernel/debug/tracing/trace_pipe"
+	UprobeEventsFile  = "uprobe_events" // top level only
+	UprobesEnableFile = "events/uprobes/enable"
+	TraceFile         = "trace"
+	TracePipeFile     = "trace_pipe"
+	TraceOptionsFile  = "trace_options"
+	SetEventPidFile   = "set_event_pid"
+	TracingOnFile     = "tracing_on"
 )
 
-// Enable writes the string "1" to the file.
+// DefaultDir is the directory of the top level instance, unless Top is
+// changed.
+const DefaultDir = "/sys/kernel/debug/tracing"
+
+// Tracing files of the top level instance in DefaultDir.
+//
+// Deprecated: Use Top.Path with the relative names, like
+// Top.Path(UprobeEventsFile), which follow Top.
+const (
+	UprobesEvents = DefaultDir + "/" + UprobeEventsFile
+	UprobesEnable = DefaultDir + "/" + UprobesEnableFile
+	Trace         = DefaultDir + "/" + TraceFile
+	TracePipe     = DefaultDir + "/" + TracePipeFile
+)
+
+// Enable writes the string "1" to the file, of the top level instance
+// unless it's an absolute path.
 func Enable(name string) error {
-	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	return Top.Enable(name)
+}
+
+// Disable writes the string "0" to the file, of the top level instance
+// unless it's an absolute path.
+func Disable(name string) error {
+	return Top.Disable(name)
+}
+
+// EventsEnable returns the file enabling the events of group, like
+// UprobesEnableFile for the default uprobes group.
+func EventsEnable(group string) string {
+	return filepath.Join("events", group, "enable")
+}
+
+// An Instance is a directory of tracing files.
+type Instance struct {
+	Dir string
+}
+
+// Top is the top level instance. Its directory can be changed to use
+// another tracefs mount, or a fake one.
+var Top = &Instance{Dir: DefaultDir}
+
+// NewInstance creates the instance name under t, which must be Top.
+func (t *Instance) NewInstance(name string) (*Instance, error) {
+	dir := filepath.Join(t.Dir, "instances", name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Instance{Dir: dir}, nil
+}
+
+// Remove removes the instance, which fails while any of its files
+// is open or any of its events is enabled.
+func (t *Instance) Remove() error {
+	return os.Remove(t.Dir)
+}
+
+// Path returns the path of the file name of the instance. Absolute
+// paths are returned as they are.
+func (t *Instance) Path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(t.Dir, name)
+}
+
+// Enable writes the string "1" to the file.
+func (t *Instance) Enable(name string) error {
+	return t.write(name, os.O_WRONLY, "1")
+}
+
+// Disable writes the string "0" to the file.
+func (t *Instance) Disable(name string) error {
+	return t.write(name, os.O_WRONLY, "0")
+}
+
+// SetOption sets the trace option name, like userstacktrace, or clears
+// it if name starts with "no", like nouserstacktrace.
+func (t *Instance) SetOption(name string) error {
+	return t.write(TraceOptionsFile, os.O_WRONLY, name)
+}
+
+// Clear empties the file. Tracing files are cleared when opened for
+// truncation, truncate(2) doesn't work on them.
+func (t *Instance) Clear(name string) error {
+	f, err := os.OpenFile(t.Path(name), os.O_WRONLY|os.O_TRUNC, 0)
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("1\n")
-	return err
+	return f.Close()
 }
 
-// Disable writes the string "0" to the file.
-func Disable(name string) error {
-	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+// Append appends the string s to the file.
+func (t *Instance) Append(name, s string) error {
+	return t.write(name, os.O_WRONLY|os.O_APPEND, s)
+}
+
+// write writes the line s to the file opened with flag.
+func (t *Instance) write(name string, flag int, s string) error {
+	f, err := os.OpenFile(t.Path(name), flag, 0)
 	if err != nil {
 		return err
 	}
-	_, err = f.WriteString("0\n")
+	_, err = f.WriteString(s + "\n")
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
 	return err
 }
@@ -0,0 +1,218 @@
+package godebug
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/gosym"
+	"fmt"
+
+	"mgk.ro/uprobes"
+)
+
+// An arch is what godebug needs to know about a machine. Registers are
+// named like the kernel names them in uprobe fetch args, which is not
+// always how Go assembly or DWARF name them.
+type arch struct {
+	goarch  string
+	ptrSize int
+
+	// Go ABI.
+	regabiMinor  int      // first Go 1.x release with the register ABI, 0 if none
+	argRegs      []string // integer argument registers of the register ABI
+	gReg         string   // register that always holds g, if any
+	regabiGReg   string   // register that holds g with the register ABI
+	tlsPrologues [][]byte // prologues that load g from TLS into cx
+	goidOffsets  []goidOffset
+	stackChecks  [][]byte // instructions comparing SP with the stack guard
+
+	// Stack at function entry.
+	retAddrSize int64 // distance between the CFA and SP
+	stackArgs   int64 // distance between SP and the first stack argument
+
+	// Machine code.
+	dwarfRegs []string // by DWARF register number
+	ret       []byte   // return instruction
+	insnSize  int      // size of every instruction, 0 if it varies
+
+	cArgRegs []string // first integer argument registers of C, nil if on the stack
+}
+
+// goidOffset is the offset of runtime.g.goid starting with a Go
+// version, for programs without DWARF.
+type goidOffset struct {
+	minor int
+	off   uint64
+}
+
+var goidOffsets64 = []goidOffset{{16, 152}, {23, 160}, {24, 152}}
+
+var arches = map[elf.Machine]*arch{
+	elf.EM_X86_64: {
+		goarch:      "amd64",
+		ptrSize:     8,
+		regabiMinor: 17,
+		argRegs:     []string{"ax", "bx", "cx", "di", "si", "r8", "r9", "r10", "r11"},
+		regabiGReg:  "r14",
+		tlsPrologues: [][]byte{
+			{0x64, 0x48, 0x8b, 0x0c, 0x25, 0xf8, 0xff, 0xff, 0xff}, // MOVQ FS:-8, CX
+		},
+		goidOffsets: goidOffsets64,
+		stackChecks: [][]byte{
+			{0x49, 0x3b, 0x66, 0x10}, // CMPQ SP, 16(R14)
+			{0x49, 0x3b, 0x66, 0x18}, // CMPQ SP, 24(R14)
+			{0x4d, 0x3b, 0x66, 0x10}, // CMPQ R12, 16(R14)
+			{0x4d, 0x3b, 0x66, 0x18}, // CMPQ R12, 24(R14)
+			{0x48, 0x3b, 0x61, 0x10}, // CMPQ SP, 16(CX)
+			{0x48, 0x3b, 0x61, 0x18}, // CMPQ SP, 24(CX)
+			{0x48, 0x3b, 0x41, 0x10}, // CMPQ AX, 16(CX)
+			{0x48, 0x3b, 0x41, 0x18}, // CMPQ AX, 24(CX)
+		},
+		retAddrSize: 8,
+		stackArgs:   8,
+		dwarfRegs: []string{"ax", "dx", "cx", "bx", "si", "di", "bp", "sp",
+			"r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15"},
+		ret:      []byte{0xc3},
+		cArgRegs: []string{"di", "si", "dx", "cx"},
+	},
+	elf.EM_386: {
+		goarch:  "386",
+		ptrSize: 4,
+		tlsPrologues: [][]byte{
+			{0x65, 0x8b, 0x0d, 0x00, 0x00, 0x00, 0x00, 0x8b, 0x89, 0xfc, 0xff, 0xff, 0xff}, // MOVL GS:0, CX; MOVL -4(CX), CX
+			{0x65, 0x8b, 0x0d, 0xfc, 0xff, 0xff, 0xff},                                     // MOVL GS:-4, CX
+		},
+		goidOffsets: []goidOffset{{16, 80}, {23, 84}, {24, 80}},
+		stackChecks: [][]byte{
+			{0x3b, 0x61, 0x08}, // CMPL SP, 8(CX)
+			{0x3b, 0x61, 0x0c}, // CMPL SP, 12(CX)
+			{0x3b, 0x41, 0x08}, // CMPL AX, 8(CX)
+			{0x3b, 0x41, 0x0c}, // CMPL AX, 12(CX)
+		},
+		retAddrSize: 4,
+		stackArgs:   4,
+		dwarfRegs:   []string{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di"},
+		ret:         []byte{0xc3},
+	},
+	elf.EM_AARCH64: {
+		goarch:      "arm64",
+		ptrSize:     8,
+		regabiMinor: 18,
+		argRegs: []string{"x0", "x1", "x2", "x3", "x4", "x5", "x6", "x7",
+			"x8", "x9", "x10", "x11", "x12", "x13", "x14", "x15"},
+		gReg:        "x28",
+		goidOffsets: goidOffsets64,
+		stackChecks: [][]byte{
+			{0x90, 0x0b, 0x40, 0xf9}, // MOVD 16(R28), R16
+			{0x90, 0x0f, 0x40, 0xf9}, // MOVD 24(R28), R16
+		},
+		retAddrSize: 0,
+		stackArgs:   8, // above the slot for the saved LR
+		dwarfRegs: []string{"x0", "x1", "x2", "x3", "x4", "x5", "x6", "x7",
+			"x8", "x9", "x10", "x11", "x12", "x13", "x14", "x15",
+			"x16", "x17", "x18", "x19", "x20", "x21", "x22", "x23",
+			"x24", "x25", "x26", "x27", "x28", "x29", "x30", "sp"},
+		ret:      []byte{0xc0, 0x03, 0x5f, 0xd6}, // RET
+		insnSize: 4,
+		cArgRegs: []string{"x0", "x1", "x2", "x3"},
+	},
+	elf.EM_RISCV: {
+		goarch:      "riscv64",
+		ptrSize:     8,
+		regabiMinor: 19,
+		argRegs: []string{"a0", "a1", "a2", "a3", "a4", "a5", "a6", "a7",
+			"s0", "s1", "s2", "s3", "s4", "s5", "s6", "s7"},
+		gReg:        "s11",
+		goidOffsets: goidOffsets64,
+		stackChecks: [][]byte{
+			{0x03, 0xb3, 0x0d, 0x01}, // MOV 16(g), X6
+			{0x03, 0xb3, 0x8d, 0x01}, // MOV 24(g), X6
+		},
+		retAddrSize: 0,
+		stackArgs:   8, // above the slot for the saved LR
+		// The kernel has no name for the zero register.
+		dwarfRegs: []string{"", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+			"s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+			"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+			"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6"},
+		ret:      []byte{0x67, 0x80, 0x00, 0x00}, // JALR X0, 0(X1)
+		insnSize: 4,
+		cArgRegs: []string{"a0", "a1", "a2", "a3"},
+	},
+}
+
+// lookupArch returns the arch of f.
+func lookupArch(f *elf.File) (*arch, error) {
+	a, ok := arches[f.Machine]
+	if !ok {
+		return nil, fmt.Errorf("unsupported machine %v", f.Machine)
+	}
+	if (a.ptrSize == 4) != (f.Class == elf.ELFCLASS32) {
+		return nil, fmt.Errorf("unsupported %v program for %v", f.Class, f.Machine)
+	}
+	return a, nil
+}
+
+// stackArg returns the fetch of the stack argument at offset off in the
+// argument frame, at function entry. The kernel's $stackN fetches words
+// of the kernel's size, which is wrong for 32-bit programs on 64-bit
+// kernels, so stack arguments are fetched relative to SP instead.
+func (a *arch) stackArg(off int64) uprobes.Deref {
+	return uprobes.Deref{Value: uprobes.Register("sp"), Offset: a.stackArgs + off}
+}
+
+// ReturnOffsets returns the offsets in the memory image of the return
+// instructions of fn. Probing them is an alternative to uretprobes,
+// which replace the return address on the stack, something the Go
+// runtime doesn't expect when it copies or unwinds the stack.
+//
+// On machines with variable length instructions, returns are found
+// where functions pop their frame, so some returns of functions without
+// a frame can be missed.
+func (p *Prog) ReturnOffsets(fn *gosym.Func) ([]uint64, error) {
+	a := p.arch
+	b, err := p.read(fn.Entry, int(fn.End-fn.Entry))
+	if err != nil {
+		return nil, err
+	}
+	var offs []uint64
+	if a.insnSize != 0 {
+		for i := 0; i+a.insnSize <= len(b); i += a.insnSize {
+			if bytes.Equal(b[i:i+a.insnSize], a.ret) {
+				offs = append(offs, fn.Entry+uint64(i)-p.load)
+			}
+		}
+		return offs, nil
+	}
+	at := func(pc uint64) bool {
+		i := pc - fn.Entry
+		return i+uint64(len(a.ret)) <= uint64(len(b)) && bytes.Equal(b[i:i+uint64(len(a.ret))], a.ret)
+	}
+	var f *funcInfo
+	if p.pcln != nil {
+		f = p.pcln.funcFor(fn.Entry)
+	}
+	if f == nil {
+		return nil, fmt.Errorf("%s: no stack pointer deltas", fn.Name)
+	}
+	rs := p.pcln.pcvalues(f.pcsp(), f.entry)
+	for _, r := range rs {
+		// Except at entry, SP is back where it was at entry only
+		// right before returning or jumping to another function.
+		if r.val == 0 && r.lo != f.entry && at(r.lo) {
+			offs = append(offs, r.lo-p.load)
+		}
+	}
+	if len(rs) == 1 && rs[0].val == 0 {
+		// No frame. The function ends with a return, unless it
+		// doesn't return at all; the linker pads functions with
+		// INT3.
+		end := len(b)
+		for end > 0 && b[end-1] == 0xcc {
+			end--
+		}
+		if pc := fn.Entry + uint64(end-len(a.ret)); end >= len(a.ret) && at(pc) {
+			offs = append(offs, pc-p.load)
+		}
+	}
+	return offs, nil
+}
@@ -0,0 +1,302 @@
+package godebug
+
+import (
+	"debug/dwarf"
+	"debug/gosym"
+	"fmt"
+	"strconv"
+
+	"mgk.ro/uprobes"
+)
+
+// Indices of the argument tables in the funcdata of a function. See
+// internal/abi/symtab.go in the Go distribution.
+const (
+	funcdataArgsPointerMaps = 0
+	funcdataArgInfo         = 5 // Go 1.17 and later
+)
+
+// Special bytes in the argument info. See runtime/traceback.go.
+const (
+	argInfoEndSeq         = 0xff
+	argInfoStartAgg       = 0xfe
+	argInfoEndAgg         = 0xfd
+	argInfoDotdotdot      = 0xfc
+	argInfoOffsetTooLarge = 0xfb
+)
+
+// Like tracebacks, probes show at most this many words of arguments.
+// It's also how many words are fetched when the arguments of a function
+// are not known.
+const (
+	maxArgWords     = 10
+	defaultArgWords = 4
+)
+
+// A frameArg is an argument of a function, or part of one, at function
+// entry.
+type frameArg struct {
+	name string       // position of the argument, like 1, or 1_0 for parts of aggregates
+	path []int        // same, nil for the words of arguments not described
+	size int64        // in bytes
+	val  fmt.Stringer // register or stack slot holding it
+}
+
+// frameArgs returns the arguments of fn, as known from the runtime
+// symbol table. Go 1.17 and later describe the arguments, including the
+// parts of structs and arrays, for tracebacks. The description doesn't
+// say which arguments are floating point, so with the register ABI, the
+// arguments that follow a floating point one are off by one register.
+// Older binaries only record the size of the argument frame, in which
+// case frameArgs returns words.
+func (p *Prog) frameArgs(fn *gosym.Func) []frameArg {
+	regs := p.argRegisters()
+	var f *funcInfo
+	if p.pcln != nil {
+		f = p.pcln.funcFor(fn.Entry)
+	}
+	if f != nil {
+		if args, ok := p.argInfo(f, regs); ok {
+			return args
+		}
+	}
+	n := p.argWords(f)
+	if regs != nil && n > len(regs) {
+		n = len(regs)
+	}
+	ps := int64(p.ptrSize())
+	args := make([]frameArg, n)
+	for i := range args {
+		args[i] = frameArg{name: strconv.Itoa(i), size: ps, val: p.arch.stackArg(int64(i) * ps)}
+		if regs != nil {
+			args[i].val = uprobes.Register(regs[i])
+		}
+	}
+	return args
+}
+
+// argWords returns how many words of arguments f takes, from the size of
+// its argument pointer map or of its argument frame, which includes the
+// results. It returns defaultArgWords if f is nil or doesn't declare its
+// frame.
+func (p *Prog) argWords(f *funcInfo) int {
+	n := defaultArgWords
+	switch {
+	case f == nil:
+	case f.funcdata(funcdataArgsPointerMaps) != 0:
+		// A stackmap starts with the number of bitmaps and the
+		// number of bits in each, one per word.
+		b, err := p.read(f.funcdata(funcdataArgsPointerMaps), 8)
+		if err != nil {
+			break
+		}
+		n = int(int32(p.pcln.bo.Uint32(b[4:])))
+	case f.args() != argsSizeUnknown:
+		ps := int32(p.ptrSize())
+		n = int((f.args() + ps - 1) / ps)
+	}
+	return min(max(n, 0), maxArgWords)
+}
+
+// argInfo decodes the argument info of f, which uses regs to pass
+// arguments, or the stack if regs is nil. It returns false if f has no
+// argument info.
+func (p *Prog) argInfo(f *funcInfo, regs []string) ([]frameArg, bool) {
+	addr := f.funcdata(funcdataArgInfo)
+	if addr == 0 {
+		return nil, false
+	}
+	var (
+		args  []frameArg
+		path  []int // index of the current argument, and of its parts
+		words int
+	)
+	path = append(path, 0)
+	next := func() {
+		path[len(path)-1]++
+	}
+	for i := uint64(0); words < maxArgWords; i++ {
+		b, err := p.read(addr+i, 1)
+		if err != nil {
+			return nil, false
+		}
+		switch o := b[0]; o {
+		case argInfoEndSeq, argInfoDotdotdot:
+			return args, true
+		case argInfoStartAgg:
+			path = append(path, 0)
+		case argInfoEndAgg:
+			if len(path) > 1 {
+				path = path[:len(path)-1]
+			}
+			next()
+		case argInfoOffsetTooLarge:
+			// The rest of the arguments are too far to be described.
+			return args, true
+		default:
+			b, err := p.read(addr+i+1, 1)
+			if err != nil {
+				return nil, false
+			}
+			i++
+			size := int64(b[0])
+			a := frameArg{name: argName(path), path: append([]int(nil), path...), size: size}
+			if regs != nil {
+				if words >= len(regs) {
+					// Arguments that don't fit in registers go on
+					// the stack, at an offset the info doesn't
+					// tell.
+					return args, true
+				}
+				a.val = uprobes.Register(regs[words])
+			} else {
+				a.val = p.arch.stackArg(int64(o))
+			}
+			args = append(args, a)
+			words += int((size + int64(p.ptrSize()) - 1) / int64(p.ptrSize()))
+			next()
+		}
+	}
+	return args, true
+}
+
+// argName names the argument at path, like 1_0 for the first field of
+// the second argument.
+func argName(path []int) string {
+	s := strconv.Itoa(path[0])
+	for _, i := range path[1:] {
+		s += "_" + strconv.Itoa(i)
+	}
+	return s
+}
+
+// paramVars returns the parameters of fn, or its results, from the debug
+// info, or nil if it doesn't describe fn.
+func (p *Prog) paramVars(fn *gosym.Func, results bool) []dwarfVar {
+	if err := p.dwarfIndex(); err != nil {
+		return nil
+	}
+	df := p.dwarf.funcs[fn.Entry]
+	if df == nil {
+		return nil
+	}
+	vs, err := p.params(df)
+	if err != nil {
+		return nil
+	}
+	var rs []dwarfVar
+	for _, v := range vs {
+		// Results are marked as variable parameters.
+		if isResult, _ := v.e.Val(dwarf.AttrVarParam).(bool); isResult == results {
+			rs = append(rs, v)
+		}
+	}
+	return rs
+}
+
+// argExpr returns the Go expression for the argument at path, as found
+// by argInfo, among the parameters params, like v.a for the first field
+// of the struct v, and whether it's a signed integer.
+func argExpr(params []dwarfVar, path []int) (expr string, signed, ok bool) {
+	if len(path) == 0 || path[0] >= len(params) {
+		return "", false, false
+	}
+	expr, t := params[path[0]].name, params[path[0]].t
+	for _, i := range path[1:] {
+		switch u := underlying(t).(type) {
+		case *dwarf.StructType:
+			if i >= len(u.Field) {
+				return "", false, false
+			}
+			expr, t = expr+"."+u.Field[i].Name, u.Field[i].Type
+		case *dwarf.ArrayType:
+			expr, t = fmt.Sprintf("%s[%d]", expr, i), u.Type
+		case *dwarf.ComplexType:
+			if i > 1 {
+				return "", false, false
+			}
+			return fmt.Sprintf("%s(%s)", [2]string{"real", "imag"}[i], expr), false, true
+		default:
+			return "", false, false
+		}
+	}
+	_, signed = underlying(t).(*dwarf.IntType)
+	return expr, signed, true
+}
+
+// A regPart is the part of a value passed in an integer register.
+type regPart struct {
+	expr   string
+	size   int64
+	signed bool
+}
+
+// regParts appends to parts the parts of the value expr, of type t,
+// passed in integer registers by the register ABI. Floating point parts
+// go in other registers. It returns false if the value is passed on the
+// stack.
+func (p *Prog) regParts(t dwarf.Type, expr string, parts *[]regPart) bool {
+	switch u := underlying(t).(type) {
+	case *dwarf.IntType:
+		*parts = append(*parts, regPart{expr, u.Size(), true})
+	case *dwarf.UintType, *dwarf.BoolType, *dwarf.CharType, *dwarf.UcharType:
+		*parts = append(*parts, regPart{expr, u.Size(), false})
+	case *dwarf.PtrType, *dwarf.FuncType:
+		*parts = append(*parts, regPart{expr, int64(p.ptrSize()), false})
+	case *dwarf.FloatType, *dwarf.ComplexType:
+	case *dwarf.StructType:
+		for _, f := range u.Field {
+			if !p.regParts(f.Type, expr+"."+f.Name, parts) {
+				return false
+			}
+		}
+	case *dwarf.ArrayType:
+		switch u.Count {
+		case 0:
+		case 1:
+			return p.regParts(u.Type, expr+"[0]", parts)
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// resultArgs returns the fetch args reading the results of fn at its
+// return, as far as the debug info describes them. Only the results
+// passed in integer registers, by the register ABI, are read. Strings
+// are read like by ExprArgs.
+func (p *Prog) resultArgs(fn *gosym.Func) uprobes.Args {
+	regs := p.argRegisters()
+	if regs == nil {
+		return nil
+	}
+	var args uprobes.Args
+	next := 0 // next free register
+	for i, v := range p.paramVars(fn, true) {
+		var parts []regPart
+		if !p.regParts(v.t, v.name, &parts) || next+len(parts) > len(regs) {
+			// On the stack; the registers stay free for the next
+			// results.
+			continue
+		}
+		name := fmt.Sprintf("ret%d", i)
+		if isString(v.t) {
+			args = append(args,
+				uprobes.Arg{Name: name, Type: uprobes.TypeChar, Value: uprobes.Deref{Value: uprobes.Register(regs[next])}, Len: MaxString, Expr: v.name, Result: true},
+				uprobes.Arg{Name: name + "_len", Type: sized(parts[1].size, true), Value: uprobes.Register(regs[next+1]), Expr: "len(" + v.name + ")", Result: true})
+		} else {
+			for j, part := range parts {
+				n := name
+				if len(parts) > 1 {
+					n += "_" + strconv.Itoa(j)
+				}
+				args = append(args, uprobes.Arg{Name: n, Type: sized(part.size, part.signed), Value: uprobes.Register(regs[next+j]), Expr: part.expr, Result: true})
+			}
+		}
+		next += len(parts)
+	}
+	return args
+}
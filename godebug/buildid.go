@@ -0,0 +1,63 @@
+package godebug
+
+import (
+	"debug/elf"
+	"encoding/hex"
+)
+
+// Note types of the build IDs.
+const (
+	ntGNUBuildID = 3 // NT_GNU_BUILD_ID
+	ntGoBuildID  = 4
+)
+
+// BuildID returns the build IDs recorded in the ELF notes of f: the GNU
+// build ID, hex encoded, and the Go build ID. Either is empty if f
+// doesn't have it.
+func BuildID(f *elf.File) (gnu, gobuild string) {
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_NOTE {
+			continue
+		}
+		b, err := s.Data()
+		if err != nil {
+			continue
+		}
+		for len(b) >= 12 {
+			namesz := int(f.ByteOrder.Uint32(b))
+			descsz := int(f.ByteOrder.Uint32(b[4:]))
+			typ := f.ByteOrder.Uint32(b[8:])
+			b = b[12:]
+			nameEnd := align4(namesz)
+			descEnd := nameEnd + align4(descsz)
+			if namesz > len(b) || descEnd > len(b) {
+				break
+			}
+			name := cstring(b[:namesz])
+			desc := b[nameEnd : nameEnd+descsz]
+			switch {
+			case name == "GNU" && typ == ntGNUBuildID:
+				gnu = hex.EncodeToString(desc)
+			case name == "Go" && typ == ntGoBuildID:
+				gobuild = cstring(desc)
+			}
+			b = b[descEnd:]
+		}
+	}
+	return gnu, gobuild
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// sameBuild reports whether the two files have the same build IDs. Files
+// without any build ID are never the same.
+func sameBuild(f1, f2 *elf.File) bool {
+	gnu1, go1 := BuildID(f1)
+	gnu2, go2 := BuildID(f2)
+	if gnu1 == "" && go1 == "" {
+		return false
+	}
+	return gnu1 == gnu2 && go1 == go2
+}
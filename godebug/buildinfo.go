@@ -0,0 +1,148 @@
+package godebug
+
+import (
+	"debug/buildinfo"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// minMinor is the oldest Go 1.x release godebug supports.
+const minMinor = 16
+
+// GoVersion returns the version of Go that built the program, e.g.
+// go1.22.1, or "" if unknown.
+func (p *Prog) GoVersion() string {
+	if p.BuildInfo == nil {
+		return ""
+	}
+	return p.BuildInfo.GoVersion
+}
+
+// GOARCH returns the architecture the program was built for.
+func (p *Prog) GOARCH() string {
+	if v := p.BuildSetting("GOARCH"); v != "" {
+		return v
+	}
+	return p.arch.goarch
+}
+
+// BuildSetting returns the value of the named build setting, e.g.
+// -buildmode, -race, CGO_ENABLED or GOEXPERIMENT, or "" if it wasn't
+// set or the build info is unknown.
+func (p *Prog) BuildSetting(key string) string {
+	if p.BuildInfo == nil {
+		return ""
+	}
+	for _, s := range p.BuildInfo.Settings {
+		if s.Key == key {
+			return s.Value
+		}
+	}
+	return ""
+}
+
+// goMinor returns the minor version of a Go 1.x version string like
+// go1.22.3 or go1.23rc1.
+func goMinor(v string) (int, bool) {
+	v, ok := strings.CutPrefix(v, "go1.")
+	if !ok {
+		return 0, false
+	}
+	i := 0
+	for i < len(v) && '0' <= v[i] && v[i] <= '9' {
+		i++
+	}
+	n, err := strconv.Atoi(v[:i])
+	return n, err == nil
+}
+
+// minor returns the minor version of Go that built the program.
+func (p *Prog) minor() (int, bool) {
+	return goMinor(p.GoVersion())
+}
+
+// readBuildInfo reads the build info of the program from r, and refuses
+// programs godebug can't handle. Programs without build info are
+// accepted, godebug falls back to guessing from the code.
+//
+// godebug reads the tables of executables built by gc for Linux, with
+// the default build mode or -buildmode=pie. Race detector builds are
+// supported, the race detector only adds calls to the runtime to the
+// code, and so are cgo programs, whose Go code and tables are like
+// those of other programs; their C functions are found by CFuncs, and
+// the code laid out by external linkers is handled by loadTables.
+// GOEXPERIMENT=noregabi selects the stack ABI, see regabi.
+func (p *Prog) readBuildInfo(r io.ReaderAt) error {
+	bi, err := buildinfo.Read(r)
+	if err != nil {
+		if noBuildInfo(err) {
+			return nil
+		}
+		return fmt.Errorf("%s: can't read build info: %v", p.path, err)
+	}
+	p.BuildInfo = bi
+	if v := p.BuildSetting("GOARCH"); v != "" && v != p.arch.goarch {
+		return fmt.Errorf("%s: built for GOARCH=%s but ELF machine is %v", p.path, v, p.Machine)
+	}
+	if minor, ok := p.minor(); ok && minor < minMinor {
+		return fmt.Errorf("%s: built with %s, need go1.%d or later", p.path, bi.GoVersion, minMinor)
+	}
+	if v := p.BuildSetting("-compiler"); v != "" && v != "gc" {
+		return fmt.Errorf("%s: built with -compiler=%s, only gc programs have the tables godebug reads", p.path, v)
+	}
+	if v := p.BuildSetting("GOOS"); v != "" && v != "linux" && v != "android" {
+		return fmt.Errorf("%s: built for GOOS=%s, not linux", p.path, v)
+	}
+	switch v := p.BuildSetting("-buildmode"); v {
+	case "", "exe", "pie":
+	default:
+		// Shared libraries and plugins have the Go code of the
+		// program, and its tables, in several files.
+		return fmt.Errorf("%s: built with -buildmode=%s, only executables are supported", p.path, v)
+	}
+	return nil
+}
+
+// noBuildInfo reports whether err, from buildinfo.Read, says the file
+// has no build info, rather than it couldn't be read. The package has
+// no exported errors to tell them apart.
+func noBuildInfo(err error) bool {
+	s := err.Error()
+	return s == "not a Go executable" || s == "unrecognized file format"
+}
+
+// regabi reports whether the program passes arguments and keeps g in
+// registers. known is false if it can't be determined from the build
+// info.
+func (p *Prog) regabi() (regabi, known bool) {
+	minor, ok := p.minor()
+	if !ok {
+		return false, false
+	}
+	for _, e := range strings.Split(p.BuildSetting("GOEXPERIMENT"), ",") {
+		if e == "noregabi" {
+			return false, true
+		}
+	}
+	first := p.arch.regabiMinor
+	return first != 0 && minor >= first, true
+}
+
+// argRegisters returns the integer argument registers of Go functions,
+// or nil if arguments are passed on the stack. Without build info, it
+// guesses from where g is kept on amd64, and assumes the register ABI
+// elsewhere.
+func (p *Prog) argRegisters() []string {
+	regabi, known := p.regabi()
+	if !known {
+		p.initGoid()
+		a := p.arch
+		regabi = a.regabiMinor != 0 && (a.regabiGReg == "" || p.goid.reg == a.regabiGReg)
+	}
+	if !regabi {
+		return nil
+	}
+	return p.arch.argRegs
+}
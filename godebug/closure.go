@@ -0,0 +1,88 @@
+package godebug
+
+import (
+	"debug/gosym"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var closureKind = regexp.MustCompile(`^(func|gowrap|deferwrap)[0-9]+$`)
+
+// A Closure tells where an anonymous function comes from: a function
+// literal, or one of the wrappers the compiler generates for defer and
+// go statements and for method values.
+type Closure struct {
+	Kind  string // "func literal", "defer statement", "go statement" or "method value"
+	Outer string // enclosing named function, like main.main
+	File  string // position of the literal or statement, if any
+	Line  int
+}
+
+// Closure returns where fn comes from, or false if fn is not anonymous.
+// The position is the one of the func keyword or of the defer or go
+// statement. Binaries older than Go 1.20 don't record it, the position
+// of the first instruction is used then.
+func (p *Prog) Closure(fn *gosym.Func) (Closure, bool) {
+	var c Closure
+	anon := anonSuffix(SplitName(fn.Name).Closure)
+	switch {
+	case anon != "":
+		c.Outer = strings.TrimSuffix(fn.Name, "."+anon)
+		switch last := anon[strings.LastIndex(anon, ".")+1:]; {
+		case strings.HasPrefix(last, "deferwrap"):
+			c.Kind = "defer statement"
+		case strings.HasPrefix(last, "gowrap"):
+			c.Kind = "go statement"
+		default:
+			c.Kind = "func literal"
+		}
+	case strings.HasSuffix(fn.Name, "-fm"):
+		// Method value wrappers have no position of their own.
+		c.Kind = "method value"
+		c.Outer = strings.TrimSuffix(fn.Name, "-fm")
+		return c, true
+	default:
+		return Closure{}, false
+	}
+	// Function literals in package level variables are named after
+	// the glob. pseudo function.
+	if strings.HasSuffix(c.Outer, ".glob.") {
+		c.Outer = strings.TrimSuffix(c.Outer, "glob.") + "init"
+	}
+	c.File, c.Line, _ = p.PCToLine(fn.Entry)
+	if p.pcln != nil {
+		if f := p.pcln.funcFor(fn.Entry); f != nil && f.startLine() != 0 {
+			c.Line = int(f.startLine())
+		}
+	}
+	return c, true
+}
+
+// anonSuffix returns the part of closure, the closure suffix of a name
+// as split by SplitName, that names anonymous functions, or "" if there
+// is none. Unlike package init functions, like init.0 or the init.6 of
+// init.6.func1, anonymous functions are numbered after a kind.
+func anonSuffix(closure string) string {
+	parts := strings.Split(closure, ".")
+	for i, part := range parts {
+		if closureKind.MatchString(part) {
+			return strings.Join(parts[i:], ".")
+		}
+	}
+	return ""
+}
+
+// Describe returns a human readable description of fn. Anonymous
+// functions are described by where they come from, as in
+// "func literal at /src/server.go:42 in main.serve (main.serve.func1)".
+func (p *Prog) Describe(fn *gosym.Func) string {
+	c, ok := p.Closure(fn)
+	if !ok {
+		return fn.Name
+	}
+	if c.File == "" {
+		return fmt.Sprintf("%s of %s (%s)", c.Kind, c.Outer, fn.Name)
+	}
+	return fmt.Sprintf("%s at %s:%d in %s (%s)", c.Kind, c.File, c.Line, c.Outer, fn.Name)
+}
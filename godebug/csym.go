@@ -0,0 +1,275 @@
+package godebug
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"mgk.ro/uprobes"
+)
+
+// A CFunc is a function that is not a Go function, found in the ELF
+// symbol tables of the program or of the shared libraries it uses.
+type CFunc struct {
+	Name   string
+	Path   string // file containing the function
+	Value  uint64 // address in the file
+	Offset uint64 // offset in the file, used by uprobes
+	Size   uint64
+}
+
+// CFuncs returns the C functions of the program and of its shared
+// libraries, grouped by file and sorted by name. The libraries are the DT_NEEDED
+// dependencies, resolved the same way the dynamic linker does, and for
+// running processes also whatever else is mapped, like dlopen plugins.
+func (p *Prog) CFuncs() ([]CFunc, error) {
+	syms, _ := p.Symbols()
+	// Go functions are left out by address, not by name: Go assembly
+	// functions have other names in the ELF symbol table, like
+	// runtime.morestack.abi0. Go code is between runtime.text and
+	// runtime.etext, which are symbols too.
+	var text, etext uint64
+	for _, s := range syms {
+		switch s.Name {
+		case "runtime.text":
+			text = s.Value
+		case "runtime.etext":
+			etext = s.Value
+		}
+	}
+	isGo := func(addr uint64) bool {
+		return text <= addr && addr <= etext || p.PCToFunc(addr) != nil
+	}
+	fns := cfuncs(p.File, syms, p.path, isGo)
+	libs, err := p.SharedLibraries()
+	if err != nil {
+		return nil, err
+	}
+	for _, lib := range libs {
+		f, err := elf.Open(lib)
+		if err != nil {
+			return nil, err
+		}
+		syms, _ := f.Symbols()
+		fns = append(fns, cfuncs(f, syms, lib, nil)...)
+		f.Close()
+	}
+	return fns, nil
+}
+
+// cfuncs returns the functions in syms and in the dynamic symbols of f,
+// which lives at path, except the ones at the addresses exclude reports,
+// if not nil.
+func cfuncs(f *elf.File, syms []elf.Symbol, path string, exclude func(addr uint64) bool) []CFunc {
+	dyn, _ := f.DynamicSymbols()
+	seen := make(map[string]bool)
+	var fns []CFunc
+	for _, s := range append(syms, dyn...) {
+		if elf.ST_TYPE(s.Info) != elf.STT_FUNC || s.Section == elf.SHN_UNDEF || s.Value == 0 {
+			continue
+		}
+		// Strip symbol versions, e.g. memcpy@@GLIBC_2.14.
+		name, _, _ := strings.Cut(s.Name, "@")
+		if name == "" || seen[name] || exclude != nil && exclude(s.Value) {
+			continue
+		}
+		off, ok := fileOffset(f, s.Value)
+		if !ok {
+			continue
+		}
+		seen[name] = true
+		fns = append(fns, CFunc{Name: name, Path: path, Value: s.Value, Offset: off, Size: s.Size})
+	}
+	sort.Slice(fns, func(i, j int) bool { return fns[i].Name < fns[j].Name })
+	return fns
+}
+
+// fileOffset returns the offset in f of the code at address addr.
+func fileOffset(f *elf.File, addr uint64) (uint64, bool) {
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && p.Vaddr <= addr && addr < p.Vaddr+p.Filesz {
+			return addr - p.Vaddr + p.Off, true
+		}
+	}
+	return 0, false
+}
+
+// SharedLibraries returns the paths of the shared libraries used by the
+// program, in dependency order. For running processes these are the
+// libraries actually mapped, as seen from the mount namespace of the
+// debugger.
+func (p *Prog) SharedLibraries() ([]string, error) {
+	if p.PID != 0 {
+		exe, err := os.Stat(p.path)
+		if err != nil {
+			return nil, err
+		}
+		var libs []string
+		for path := range p.Objects() {
+			if fi, err := os.Stat(path); err != nil || os.SameFile(fi, exe) {
+				continue
+			}
+			if !isSharedObject(path, p.Machine) {
+				continue
+			}
+			libs = append(libs, path)
+		}
+		sort.Strings(libs)
+		return libs, nil
+	}
+	var libs []string
+	seen := make(map[string]bool)
+	queue := []string{p.path}
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		f, err := elf.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		needed, _ := f.ImportedLibraries()
+		dirs := searchPath(f, path)
+		f.Close()
+		for _, name := range needed {
+			lib, err := findLibrary(name, dirs, p.Machine)
+			if err != nil {
+				return nil, err
+			}
+			if seen[lib] {
+				continue
+			}
+			seen[lib] = true
+			libs = append(libs, lib)
+			queue = append(queue, lib)
+		}
+	}
+	return libs, nil
+}
+
+// isSharedObject reports whether path is an ELF shared object for the
+// same machine.
+func isSharedObject(path string, m elf.Machine) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return f.Type == elf.ET_DYN && f.Machine == m
+}
+
+// searchPath returns the directories searched by the dynamic linker for
+// the dependencies of f, which lives at path: DT_RPATH if there's no
+// DT_RUNPATH, LD_LIBRARY_PATH, DT_RUNPATH, ld.so.conf and the default
+// directories.
+func searchPath(f *elf.File, path string) []string {
+	origin := filepath.Dir(path)
+	expand := func(list []string) []string {
+		var dirs []string
+		for _, l := range list {
+			for _, d := range filepath.SplitList(l) {
+				d = strings.ReplaceAll(d, "${ORIGIN}", origin)
+				dirs = append(dirs, strings.ReplaceAll(d, "$ORIGIN", origin))
+			}
+		}
+		return dirs
+	}
+	rpath, _ := f.DynString(elf.DT_RPATH)
+	runpath, _ := f.DynString(elf.DT_RUNPATH)
+	var dirs []string
+	if len(runpath) == 0 {
+		dirs = append(dirs, expand(rpath)...)
+	}
+	dirs = append(dirs, filepath.SplitList(os.Getenv("LD_LIBRARY_PATH"))...)
+	dirs = append(dirs, expand(runpath)...)
+	dirs = append(dirs, ldSoConf("/etc/ld.so.conf")...)
+	return append(dirs, "/lib64", "/usr/lib64", "/lib", "/usr/lib")
+}
+
+// ldSoConf returns the directories listed in the ld.so.conf file.
+func ldSoConf(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var dirs []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		line = strings.TrimSpace(line)
+		if pattern, ok := strings.CutPrefix(line, "include"); ok {
+			pattern = strings.TrimSpace(pattern)
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(file), pattern)
+			}
+			files, _ := filepath.Glob(pattern)
+			for _, f := range files {
+				dirs = append(dirs, ldSoConf(f)...)
+			}
+			continue
+		}
+		if line != "" {
+			dirs = append(dirs, line)
+		}
+	}
+	return dirs
+}
+
+// findLibrary looks for the shared library name in dirs.
+func findLibrary(name string, dirs []string, m elf.Machine) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if isSharedObject(path, m) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("can't find shared library %s", name)
+}
+
+// CUprobe will return an uprobes event suitable for tracing the specified
+// C function. Events for functions in shared libraries are named after
+// the library too, and they fire in every process that uses the
+// library, not only in p.
+func CUprobe(p *Prog, fn CFunc) *uprobes.Event {
+	ev := uprobes.NewEvent(p.Names.Name(cSymbol(p, fn), ""), fn.Path, fn.Offset)
+	p.describe(ev, "call of C function %s", fn.Name)
+	regs := p.arch.cArgRegs
+	if regs == nil {
+		// Arguments are on the stack.
+		ps := int64(p.ptrSize())
+		for i := int64(0); i < 4; i++ {
+			name := fmt.Sprintf("a%d", i)
+			ev.FetchArgs = append(ev.FetchArgs, uprobes.Arg{Name: name, Type: sized(ps, false), Value: p.arch.stackArg(i * ps), Expr: name})
+		}
+		return ev
+	}
+	for i, r := range regs {
+		ev = ev.Register(fmt.Sprintf("a%d", i), r).U64()
+		ev.FetchArgs[len(ev.FetchArgs)-1].Expr = fmt.Sprintf("a%d", i)
+	}
+	return ev
+}
+
+// CUretProbe will return an uretprobe event suitable for tracing the
+// specified C function return.
+func CUretProbe(p *Prog, fn CFunc) *uprobes.Event {
+	ev := uprobes.NewEvent(p.Names.Name(cSymbol(p, fn), "_ret"), fn.Path, fn.Offset).Return().RetVal("ret")
+	ev.FetchArgs[0].Expr, ev.FetchArgs[0].Result = "ret", true
+	return p.describe(ev, "return from C function %s", fn.Name)
+}
+
+// cSymbol returns the name of fn for event names. Functions in shared
+// libraries are qualified by the library, as in libc.so.6:malloc.
+func cSymbol(p *Prog, fn CFunc) string {
+	if fn.Path == p.path {
+		return fn.Name
+	}
+	return filepath.Base(fn.Path) + ":" + fn.Name
+}
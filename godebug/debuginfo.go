@@ -0,0 +1,143 @@
+package godebug
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// DebugDirs are the directories searched for separate debug info files
+// of stripped programs. For a program with GNU build ID abcdef... the
+// file is DIR/.build-id/ab/cdef....debug, for a program with Go build ID
+// x/y/z it is DIR/.build-id/go/x/y/z.debug. Files named by
+// .gnu_debuglink are looked for next to the program, in its .debug
+// subdirectory and in DIR followed by the directory of the program.
+var DebugDirs = []string{"/usr/lib/debug"}
+
+// stripped reports whether f lacks either a symbol table or DWARF.
+func stripped(f *elf.File) bool {
+	return f.Section(".symtab") == nil || f.Section(".debug_info") == nil && f.Section(".zdebug_info") == nil
+}
+
+// findDebugFile returns the separate debug info file of f, which lives
+// at path, and its path.
+func findDebugFile(f *elf.File, path string) (*elf.File, string, error) {
+	gnu, gobuild := BuildID(f)
+	var candidates []string
+	for _, dir := range DebugDirs {
+		if len(gnu) > 2 {
+			candidates = append(candidates, filepath.Join(dir, ".build-id", gnu[:2], gnu[2:]+".debug"))
+		}
+		if gobuild != "" {
+			candidates = append(candidates, filepath.Join(dir, ".build-id", "go", gobuild+".debug"))
+		}
+	}
+	for _, c := range candidates {
+		d, err := elf.Open(c)
+		if err != nil {
+			continue
+		}
+		if sameBuild(f, d) {
+			return d, c, nil
+		}
+		d.Close()
+	}
+	name, crc, ok := debugLink(f)
+	if !ok {
+		return nil, "", errors.New("no separate debug info")
+	}
+	dir := filepath.Dir(path)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	candidates = []string{filepath.Join(dir, name), filepath.Join(dir, ".debug", name)}
+	for _, d := range DebugDirs {
+		candidates = append(candidates, filepath.Join(d, dir, name))
+	}
+	for _, c := range candidates {
+		if c == path {
+			continue
+		}
+		b, err := os.ReadFile(c)
+		if err != nil || crc32.ChecksumIEEE(b) != crc {
+			continue
+		}
+		d, err := elf.Open(c)
+		if err != nil {
+			continue
+		}
+		return d, c, nil
+	}
+	return nil, "", errors.New("separate debug info " + name + " not found")
+}
+
+// debugLink returns the file name and the checksum recorded in the
+// .gnu_debuglink section of f.
+func debugLink(f *elf.File) (name string, crc uint32, ok bool) {
+	s := f.Section(".gnu_debuglink")
+	if s == nil {
+		return "", 0, false
+	}
+	b, err := s.Data()
+	if err != nil {
+		return "", 0, false
+	}
+	name = cstring(b)
+	// The name is followed by padding to 4 bytes, then the CRC.
+	off := align4(len(name) + 1)
+	if name == "" || off+4 > len(b) {
+		return "", 0, false
+	}
+	return name, f.ByteOrder.Uint32(b[off:]), true
+}
+
+// DebugFile returns the path of the separate debug info file used for
+// the program, or "" if the program has its own debug info or none was
+// found.
+func (p *Prog) DebugFile() string {
+	return p.debugPath
+}
+
+// DWARF returns the DWARF debug info of the program, from the separate
+// debug info file if the program is stripped.
+func (p *Prog) DWARF() (*dwarf.Data, error) {
+	if p.dwarf.done {
+		return p.dwarf.d, p.dwarf.err
+	}
+	p.dwarf.done = true
+	p.dwarf.file = p.File
+	p.dwarf.d, p.dwarf.err = p.File.DWARF()
+	if p.dwarf.err != nil && p.debug != nil {
+		p.dwarf.file = p.debug
+		p.dwarf.d, p.dwarf.err = p.debug.DWARF()
+	}
+	return p.dwarf.d, p.dwarf.err
+}
+
+// Symbols returns the symbol table of the program, from the separate
+// debug info file if the program is stripped.
+func (p *Prog) Symbols() ([]elf.Symbol, error) {
+	syms, err := p.File.Symbols()
+	if err != nil && p.debug != nil {
+		return p.debug.Symbols()
+	}
+	return syms, err
+}
+
+// section returns the named section with contents, looking in the
+// separate debug info file if the program doesn't have it.
+func section(f, debug *elf.File, name string) *elf.Section {
+	if s := f.Section(name); s != nil && s.Type != elf.SHT_NOBITS {
+		return s
+	}
+	if debug == nil {
+		return nil
+	}
+	if s := debug.Section(name); s != nil && s.Type != elf.SHT_NOBITS {
+		return s
+	}
+	return nil
+}
@@ -0,0 +1,539 @@
+package godebug
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+
+	"mgk.ro/uprobes"
+)
+
+// dwarfInfo caches the DWARF of the program.
+type dwarfInfo struct {
+	done    bool
+	d       *dwarf.Data
+	err     error
+	file    *elf.File              // file the DWARF comes from
+	funcs   map[uint64]*dwarfEntry // out-of-line functions by entry PC
+	globals map[string]*dwarfEntry // package level variables by name
+}
+
+// dwarfEntry is a DWARF entry and its compilation unit.
+type dwarfEntry struct {
+	cu *dwarf.Entry
+	e  *dwarf.Entry
+}
+
+// dwarfIndex indexes the functions and the package level variables of
+// the program.
+func (p *Prog) dwarfIndex() error {
+	d, err := p.DWARF()
+	if err != nil {
+		return err
+	}
+	if p.dwarf.funcs != nil {
+		return nil
+	}
+	funcs := make(map[uint64]*dwarfEntry)
+	globals := make(map[string]*dwarfEntry)
+	r := d.Reader()
+	var cu *dwarf.Entry
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			break
+		}
+		switch e.Tag {
+		case dwarf.TagCompileUnit:
+			cu = e
+			continue
+		case dwarf.TagSubprogram:
+			if pc, ok := e.Val(dwarf.AttrLowpc).(uint64); ok {
+				funcs[pc] = &dwarfEntry{cu, e}
+			}
+		case dwarf.TagVariable:
+			if name, ok := e.Val(dwarf.AttrName).(string); ok {
+				globals[name] = &dwarfEntry{cu, e}
+			}
+		}
+		if e.Children {
+			r.SkipChildren()
+		}
+	}
+	p.dwarf.funcs, p.dwarf.globals = funcs, globals
+	return nil
+}
+
+// dwarfVar is a parameter or a local variable.
+type dwarfVar struct {
+	name  string
+	param bool
+	t     dwarf.Type
+	e     *dwarf.Entry
+}
+
+// params returns the parameters of the function, including results.
+func (p *Prog) params(df *dwarfEntry) ([]dwarfVar, error) {
+	d, err := p.DWARF()
+	if err != nil {
+		return nil, err
+	}
+	r := d.Reader()
+	r.Seek(df.e.Offset)
+	if _, err := r.Next(); err != nil {
+		return nil, err
+	}
+	var vs []dwarfVar
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil || e.Tag == 0 {
+			break
+		}
+		if e.Children {
+			r.SkipChildren()
+		}
+		if e.Tag != dwarf.TagFormalParameter {
+			continue
+		}
+		v, ok, err := p.newVar(e)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			vs = append(vs, v)
+		}
+	}
+	return vs, nil
+}
+
+// DWARF location expression operations. See the DWARF 5 standard,
+// section 7.7.1.
+const (
+	opAddr         = 0x03
+	opDeref        = 0x06
+	opConstu       = 0x10
+	opConsts       = 0x11
+	opPlus         = 0x22
+	opPlusUconst   = 0x23
+	opLit0         = 0x30
+	opLit31        = 0x4f
+	opReg0         = 0x50
+	opReg31        = 0x6f
+	opBreg0        = 0x70
+	opBreg31       = 0x8f
+	opRegx         = 0x90
+	opFbreg        = 0x91
+	opPiece        = 0x93
+	opNop          = 0x96
+	opCallFrameCFA = 0x9c
+)
+
+// DWARF 5 location list entries, section 7.7.3.
+const (
+	lleEndOfList       = 0x00
+	lleBaseAddressx    = 0x01
+	lleStartxEndx      = 0x02
+	lleStartxLength    = 0x03
+	lleOffsetPair      = 0x04
+	lleDefaultLocation = 0x05
+	lleBaseAddress     = 0x06
+	lleStartEnd        = 0x07
+	lleStartLength     = 0x08
+)
+
+// ptrSize returns the size of pointers in the program.
+func (p *Prog) ptrSize() int {
+	return p.arch.ptrSize
+}
+
+// location returns the location expression of the variable e, from the
+// compilation unit cu, that is valid at pc. It returns nil if the
+// variable has no location at pc.
+func (p *Prog) location(cu, e *dwarf.Entry, pc uint64) ([]byte, error) {
+	f := e.AttrField(dwarf.AttrLocation)
+	if f == nil {
+		return nil, nil
+	}
+	switch f.Class {
+	case dwarf.ClassExprLoc, dwarf.ClassBlock:
+		return f.Val.([]byte), nil
+	case dwarf.ClassLocListPtr:
+		return p.locList(cu, f.Val.(int64), pc)
+	}
+	return nil, fmt.Errorf("unsupported location class %v", f.Class)
+}
+
+// locList returns the expression valid at pc in the location list at
+// offset off.
+func (p *Prog) locList(cu *dwarf.Entry, off int64, pc uint64) ([]byte, error) {
+	if _, err := p.DWARF(); err != nil {
+		return nil, err
+	}
+	f := p.dwarf.file
+	base, _ := cu.Val(dwarf.AttrLowpc).(uint64)
+	if b, ok, err := p.dwarfSection(f, ".debug_loclists"); ok {
+		if err != nil {
+			return nil, err
+		}
+		return p.locList5(f, cu, b, off, base, pc)
+	}
+	b, ok, err := p.dwarfSection(f, ".debug_loc")
+	if !ok {
+		return nil, errors.New("no location lists")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.locList4(f, b, off, base, pc)
+}
+
+// dwarfSection returns the contents of the DWARF section name of f, like
+// .debug_loc, and whether f has it. Older linkers compress DWARF into
+// sections named like .zdebug_loc, which Section.Data decompresses.
+func (p *Prog) dwarfSection(f *elf.File, name string) ([]byte, bool, error) {
+	s := f.Section(name)
+	if s == nil {
+		s = f.Section(".z" + name[1:])
+	}
+	if s == nil {
+		return nil, false, nil
+	}
+	b, err := p.sectionData(s)
+	return b, true, err
+}
+
+var errLocList = errors.New("bad location list")
+
+// locList4 decodes a DWARF 4 location list.
+func (p *Prog) locList4(f *elf.File, b []byte, off int64, base, pc uint64) ([]byte, error) {
+	if off < 0 || off > int64(len(b)) {
+		return nil, errLocList
+	}
+	b = b[off:]
+	ps := p.ptrSize()
+	word := func() uint64 {
+		if ps == 4 {
+			return uint64(f.ByteOrder.Uint32(b))
+		}
+		return f.ByteOrder.Uint64(b)
+	}
+	maxAddr := ^uint64(0) >> (64 - 8*ps)
+	for len(b) >= 2*ps {
+		lo := word()
+		b = b[ps:]
+		hi := word()
+		b = b[ps:]
+		switch {
+		case lo == 0 && hi == 0:
+			return nil, nil
+		case lo == maxAddr:
+			base = hi
+			continue
+		}
+		if len(b) < 2 {
+			break
+		}
+		n := int(f.ByteOrder.Uint16(b))
+		b = b[2:]
+		if n > len(b) {
+			break
+		}
+		if base+lo <= pc && pc < base+hi {
+			return b[:n], nil
+		}
+		b = b[n:]
+	}
+	return nil, errLocList
+}
+
+// locList5 decodes a DWARF 5 location list.
+func (p *Prog) locList5(f *elf.File, cu *dwarf.Entry, b []byte, off int64, base, pc uint64) ([]byte, error) {
+	if off < 0 || off > int64(len(b)) {
+		return nil, errLocList
+	}
+	b = b[off:]
+	ps := p.ptrSize()
+	bad := false
+	uleb := func() uint64 {
+		v, n := uleb128(b)
+		if n <= 0 {
+			bad = true
+			return 0
+		}
+		b = b[n:]
+		return v
+	}
+	addr := func() uint64 {
+		if len(b) < ps {
+			bad = true
+			return 0
+		}
+		var v uint64
+		if ps == 4 {
+			v = uint64(f.ByteOrder.Uint32(b))
+		} else {
+			v = f.ByteOrder.Uint64(b)
+		}
+		b = b[ps:]
+		return v
+	}
+	addrx := func() uint64 {
+		v, err := p.debugAddr(f, cu, uleb())
+		if err != nil {
+			bad = true
+		}
+		return v
+	}
+	var deflt []byte
+	for len(b) > 0 && !bad {
+		kind := b[0]
+		b = b[1:]
+		var lo, hi uint64
+		switch kind {
+		case lleEndOfList:
+			return deflt, nil
+		case lleBaseAddressx:
+			base = addrx()
+			continue
+		case lleBaseAddress:
+			base = addr()
+			continue
+		case lleStartxEndx:
+			lo = addrx()
+			hi = addrx()
+		case lleStartxLength:
+			lo = addrx()
+			hi = lo + uleb()
+		case lleOffsetPair:
+			lo = base + uleb()
+			hi = base + uleb()
+		case lleDefaultLocation:
+		case lleStartEnd:
+			lo = addr()
+			hi = addr()
+		case lleStartLength:
+			lo = addr()
+			hi = lo + uleb()
+		default:
+			return nil, errLocList
+		}
+		n := uleb()
+		if bad || n > uint64(len(b)) {
+			break
+		}
+		expr := b[:n]
+		b = b[n:]
+		if kind == lleDefaultLocation {
+			deflt = expr
+		} else if lo <= pc && pc < hi {
+			return expr, nil
+		}
+	}
+	return nil, errLocList
+}
+
+// debugAddr returns the ith entry of the address table of the
+// compilation unit cu.
+func (p *Prog) debugAddr(f *elf.File, cu *dwarf.Entry, i uint64) (uint64, error) {
+	b, ok, err := p.dwarfSection(f, ".debug_addr")
+	if !ok {
+		return 0, errors.New("no .debug_addr")
+	}
+	if err != nil {
+		return 0, err
+	}
+	base, _ := cu.Val(dwarf.AttrAddrBase).(int64)
+	ps := uint64(p.ptrSize())
+	off := uint64(base) + i*ps
+	if off+ps > uint64(len(b)) {
+		return 0, errors.New("bad .debug_addr index")
+	}
+	if ps == 4 {
+		return uint64(f.ByteOrder.Uint32(b[off:])), nil
+	}
+	return f.ByteOrder.Uint64(b[off:]), nil
+}
+
+func uleb128(b []byte) (uint64, int) {
+	var v uint64
+	for i, c := range b {
+		if i == 10 {
+			break
+		}
+		v |= uint64(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+func sleb128(b []byte) (int64, int) {
+	var v int64
+	for i, c := range b {
+		if i == 10 {
+			break
+		}
+		v |= int64(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			if shift := 7 * (i + 1); shift < 64 && c&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// A piece is part of a variable when the probe hits.
+type piece struct {
+	size int64        // 0 for the whole variable
+	val  fmt.Stringer // uprobes.Register or uprobes.Deref; nil if unavailable
+}
+
+// address is a value computed on the DWARF expression stack: the value
+// fetched by base, if not nil, plus off.
+type address struct {
+	base fmt.Stringer
+	off  int64
+}
+
+// evalLocation turns the location expression expr into fetches. cfa is
+// the distance between SP and the CFA when the probe hits. Go uses the
+// CFA as frame base.
+func (p *Prog) evalLocation(expr []byte, cfa int64) ([]piece, error) {
+	regs := p.arch.dwarfRegs
+	reg := func(n uint64) (string, error) {
+		if n >= uint64(len(regs)) || regs[n] == "" {
+			return "", fmt.Errorf("unknown DWARF register %d", n)
+		}
+		return regs[n], nil
+	}
+	sp := uprobes.Register("sp")
+	var (
+		pieces []piece
+		stack  []address
+		inReg  string // register holding the current piece, if any
+	)
+	push := func(a address) { stack = append(stack, a) }
+	pop := func() (address, error) {
+		if len(stack) == 0 {
+			return address{}, errors.New("DWARF expression stack underflow")
+		}
+		a := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return a, nil
+	}
+	// value returns where the current piece is.
+	value := func() (fmt.Stringer, error) {
+		if inReg != "" {
+			return uprobes.Register(inReg), nil
+		}
+		if len(stack) == 0 {
+			return nil, nil
+		}
+		a, _ := pop()
+		if a.base == nil {
+			// Relative to the program file, so that it works for
+			// position independent executables.
+			return uprobes.Offset(uint64(a.off) - p.load), nil
+		}
+		return uprobes.Deref{Value: a.base, Offset: a.off}, nil
+	}
+	for len(expr) > 0 {
+		op := expr[0]
+		expr = expr[1:]
+		uarg := func() uint64 {
+			v, n := uleb128(expr)
+			expr = expr[n:]
+			return v
+		}
+		sarg := func() int64 {
+			v, n := sleb128(expr)
+			expr = expr[n:]
+			return v
+		}
+		var err error
+		switch {
+		case op == opAddr:
+			if len(expr) < p.ptrSize() {
+				return nil, errors.New("truncated DWARF expression")
+			}
+			a := address{nil, int64(p.ByteOrder.Uint32(expr))}
+			if p.ptrSize() == 8 {
+				a.off = int64(p.ByteOrder.Uint64(expr))
+			}
+			expr = expr[p.ptrSize():]
+			push(a)
+		case opReg0 <= op && op <= opReg31:
+			inReg, err = reg(uint64(op - opReg0))
+		case op == opRegx:
+			inReg, err = reg(uarg())
+		case opBreg0 <= op && op <= opBreg31:
+			var r string
+			r, err = reg(uint64(op - opBreg0))
+			push(address{uprobes.Register(r), sarg()})
+		case op == opFbreg:
+			push(address{sp, cfa + sarg()})
+		case op == opCallFrameCFA:
+			push(address{sp, cfa})
+		case opLit0 <= op && op <= opLit31:
+			push(address{nil, int64(op - opLit0)})
+		case op == opConstu:
+			push(address{nil, int64(uarg())})
+		case op == opConsts:
+			push(address{nil, sarg()})
+		case op == opPlusUconst:
+			var a address
+			a, err = pop()
+			a.off += int64(uarg())
+			push(a)
+		case op == opPlus:
+			var a, b address
+			if b, err = pop(); err == nil {
+				a, err = pop()
+			}
+			if a.base != nil && b.base != nil {
+				return nil, errors.New("DWARF expression adds two fetched values")
+			}
+			if a.base == nil {
+				a.base = b.base
+			}
+			push(address{a.base, a.off + b.off})
+		case op == opDeref:
+			var a address
+			a, err = pop()
+			if a.base == nil {
+				return nil, fmt.Errorf("DWARF expression reads absolute address %#x", a.off)
+			}
+			push(address{uprobes.Deref{Value: a.base, Offset: a.off}, 0})
+		case op == opPiece:
+			size := int64(uarg())
+			var v fmt.Stringer
+			v, err = value()
+			pieces = append(pieces, piece{size, v})
+			inReg, stack = "", nil
+		case op == opNop:
+		default:
+			return nil, unsupportedOp(op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pieces != nil {
+		return pieces, nil
+	}
+	v, err := value()
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return []piece{{0, v}}, nil
+}
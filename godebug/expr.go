@@ -0,0 +1,271 @@
+package godebug
+
+import (
+	"debug/dwarf"
+	"debug/gosym"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"mgk.ro/uprobes"
+)
+
+// MaxString is how many bytes of Go strings are fetched. Go strings are
+// not NUL terminated, so they are fetched as arrays of this size.
+var MaxString = 32
+
+// ErrNoVariable is returned for expressions that name a variable the
+// function doesn't have.
+var ErrNoVariable = errors.New("no such variable")
+
+var exprSyntax = regexp.MustCompile(`^[\pL_][\pL\pN_]*(\.[\pL_][\pL\pN_]*)*$`)
+
+// ExprArgs returns the fetch args that read expr when fn is entered,
+// and the type of the value read. expr is the name of a parameter of fn
+// followed by field selectors, as in req.URL.Path. Like in Go, pointers
+// to structs are followed implicitly. Go strings are read as arrays of
+// MaxString chars, with an extra arg holding their length.
+func (p *Prog) ExprArgs(fn *gosym.Func, expr string) (uprobes.Args, dwarf.Type, error) {
+	if !exprSyntax.MatchString(expr) {
+		return nil, nil, fmt.Errorf("bad expression %q", expr)
+	}
+	fields := strings.Split(expr, ".")
+	if err := p.dwarfIndex(); err != nil {
+		return nil, nil, err
+	}
+	df := p.dwarf.funcs[fn.Entry]
+	if df == nil {
+		return nil, nil, fmt.Errorf("%s: %w", fields[0], ErrNoVariable)
+	}
+	vs, err := p.params(df)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, v := range vs {
+		if v.name != fields[0] {
+			continue
+		}
+		return p.varArgs(df.cu, v, fn.Entry, p.arch.retAddrSize, expr, fields[1:])
+	}
+	return nil, nil, fmt.Errorf("%s: %w", fields[0], ErrNoVariable)
+}
+
+// GlobalArgs returns the fetch args that read expr, and the type of the
+// value read. expr is the name of a package level variable followed by
+// field selectors, as in net/http.DefaultClient.Timeout, see ExprArgs.
+// The variable is read at an offset relative to the program file, so
+// the args work in any probe of the program, including in position
+// independent executables.
+func (p *Prog) GlobalArgs(expr string) (uprobes.Args, dwarf.Type, error) {
+	if err := p.dwarfIndex(); err != nil {
+		return nil, nil, err
+	}
+	// The package path can contain dots too, try every split.
+	slash := strings.LastIndex(expr, "/")
+	parts := strings.Split(expr[slash+1:], ".")
+	for i := 2; i <= len(parts); i++ {
+		name := expr[:slash+1] + strings.Join(parts[:i], ".")
+		g := p.dwarf.globals[name]
+		if g == nil {
+			continue
+		}
+		fields := parts[i:]
+		if len(fields) > 0 && !exprSyntax.MatchString(strings.Join(fields, ".")) {
+			return nil, nil, fmt.Errorf("bad expression %q", expr)
+		}
+		off, ok := g.e.Val(dwarf.AttrType).(dwarf.Offset)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s has no type", name)
+		}
+		t, err := p.dwarf.d.Type(off)
+		if err != nil {
+			return nil, nil, err
+		}
+		loc, err := p.location(g.cu, g.e, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		pieces, err := p.evalLocation(loc, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if pieces == nil {
+			return nil, nil, fmt.Errorf("%s has been optimized away", name)
+		}
+		return p.compileFields(expr, t, pieces, fields)
+	}
+	return nil, nil, fmt.Errorf("%s: %w", expr, ErrNoVariable)
+}
+
+// compileFields follows the field selectors starting from a value of
+// type t made of pieces, and returns the fetch args reading the result,
+// named after expr.
+func (p *Prog) compileFields(expr string, t dwarf.Type, pieces []piece, fields []string) (uprobes.Args, dwarf.Type, error) {
+	path := strings.TrimSuffix(expr, "."+strings.Join(fields, "."))
+	for _, f := range fields {
+		if pt, ok := underlying(t).(*dwarf.PtrType); ok {
+			ptr, err := p.part(path, pieces, 0, int64(p.ptrSize()))
+			if err != nil {
+				return nil, nil, err
+			}
+			t, pieces = pt.Type, []piece{{0, uprobes.Deref{Value: ptr}}}
+		}
+		st, ok := underlying(t).(*dwarf.StructType)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s has type %s, which has no fields", path, t)
+		}
+		field := structField(st, f)
+		if field == nil {
+			return nil, nil, fmt.Errorf("%s has type %s, which has no field %s", path, t, f)
+		}
+		path += "." + f
+		v, err := p.part(path, pieces, field.ByteOffset, field.Type.Size())
+		if err != nil {
+			return nil, nil, err
+		}
+		t, pieces = field.Type, []piece{{0, v}}
+	}
+	name := readable(expr)
+	if isString(t) {
+		ps := int64(p.ptrSize())
+		data, err := p.part(expr, pieces, 0, ps)
+		if err != nil {
+			return nil, nil, err
+		}
+		n, err := p.part(expr, pieces, ps, ps)
+		if err != nil {
+			return nil, nil, err
+		}
+		args := uprobes.Args{
+			{Name: name, Type: uprobes.TypeChar, Value: uprobes.Deref{Value: data}, Len: MaxString, Expr: expr},
+			{Name: name + "_len", Type: sized(ps, true), Value: n, Expr: "len(" + expr + ")"},
+		}
+		return args, t, nil
+	}
+	typ, ok := p.fetchType(t)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s has type %s, which can't be fetched; select a field", expr, t)
+	}
+	v, err := p.part(expr, pieces, 0, underlying(t).Size())
+	if err != nil {
+		return nil, nil, err
+	}
+	return uprobes.Args{{Name: name, Type: typ, Value: v, Expr: expr}}, t, nil
+}
+
+// part returns the fetch reading size bytes at offset off in the value
+// made of pieces.
+func (p *Prog) part(path string, pieces []piece, off, size int64) (fmt.Stringer, error) {
+	var start int64
+	for _, pc := range merge(pieces) {
+		end := start + pc.size
+		if pc.size == 0 {
+			end = off + size
+		}
+		if start <= off && off+size <= end {
+			switch v := pc.val.(type) {
+			case nil:
+				return nil, fmt.Errorf("%s is optimized out", path)
+			case uprobes.Deref:
+				v.Offset += off - start
+				return v, nil
+			case uprobes.Offset:
+				return v + uprobes.Offset(off-start), nil
+			case uprobes.Register:
+				if off != start || size > int64(p.ptrSize()) {
+					break
+				}
+				return v, nil
+			}
+			break
+		}
+		start = end
+	}
+	return nil, fmt.Errorf("%s is split across registers", path)
+}
+
+// merge joins the pieces that are next to each other in memory, like the
+// halves of 64-bit values on 32-bit machines.
+func merge(pieces []piece) []piece {
+	var m []piece
+	for _, pc := range pieces {
+		if n := len(m); n > 0 && m[n-1].size != 0 {
+			prev, ok1 := m[n-1].val.(uprobes.Deref)
+			cur, ok2 := pc.val.(uprobes.Deref)
+			if ok1 && ok2 && prev.Value == cur.Value && prev.Offset+m[n-1].size == cur.Offset {
+				m[n-1].size += pc.size
+				continue
+			}
+		}
+		m = append(m, pc)
+	}
+	return m
+}
+
+// structField returns the named field of st, or nil.
+func structField(st *dwarf.StructType, name string) *dwarf.StructField {
+	for _, f := range st.Field {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// underlying strips typedefs from t.
+func underlying(t dwarf.Type) dwarf.Type {
+	for {
+		td, ok := t.(*dwarf.TypedefType)
+		if !ok {
+			return t
+		}
+		t = td.Type
+	}
+}
+
+// isString reports whether t is a Go string.
+func isString(t dwarf.Type) bool {
+	st, ok := underlying(t).(*dwarf.StructType)
+	return ok && st.StructName == "string"
+}
+
+// fetchType returns the uprobes type that reads values of type t.
+// Floating point values are read as their bits.
+func (p *Prog) fetchType(t dwarf.Type) (uprobes.Type, bool) {
+	switch t := underlying(t).(type) {
+	case *dwarf.IntType:
+		return sizedOK(t.Size(), true)
+	case *dwarf.UintType, *dwarf.BoolType, *dwarf.CharType, *dwarf.UcharType, *dwarf.FloatType:
+		return sizedOK(t.Size(), false)
+	case *dwarf.PtrType, *dwarf.FuncType:
+		return sized(int64(p.ptrSize()), false), true
+	}
+	return uprobes.TypeNone, false
+}
+
+// sized returns the integer type of the specified size in bytes.
+func sized(size int64, signed bool) uprobes.Type {
+	t, _ := sizedOK(size, signed)
+	return t
+}
+
+func sizedOK(size int64, signed bool) (uprobes.Type, bool) {
+	var t uprobes.Type
+	switch size {
+	case 1:
+		t = uprobes.TypeU8
+	case 2:
+		t = uprobes.TypeU16
+	case 4:
+		t = uprobes.TypeU32
+	case 8:
+		t = uprobes.TypeU64
+	default:
+		return uprobes.TypeNone, false
+	}
+	if signed {
+		t += uprobes.TypeS8 - uprobes.TypeU8
+	}
+	return t, true
+}
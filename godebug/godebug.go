@@ -4,9 +4,13 @@ Package godebug implements helper functions for debugging Go programs.
 package godebug // import "mgk.ro/godebug"
 
 import (
+	"debug/buildinfo"
 	"debug/elf"
 	"debug/gosym"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
@@ -15,14 +19,15 @@ import (
 )
 
 // ProgLoadAddr returns the program load address. It's useful to calculate
-// file offset from VA for uprobes.
-func ProgLoadAddr(f *elf.File) uint64 {
+// file offset from VA for uprobes. It fails if the program has no
+// loadable segment of code.
+func ProgLoadAddr(f *elf.File) (uint64, error) {
 	for _, p := range f.Progs {
 		if p.Type == elf.PT_LOAD && p.Flags == elf.PF_X|elf.PF_R {
-			return p.Vaddr - p.Off
+			return p.Vaddr - p.Off, nil
 		}
 	}
-	panic("program load address not found")
+	return 0, errors.New("program load address not found")
 }
 
 // Prog is a representation of the debugged program.
@@ -30,45 +35,215 @@ type Prog struct {
 	*elf.File
 	*gosym.Table
 
-	path string
-	load uint64
+	// BuildInfo is the build information embedded by the Go
+	// toolchain, or nil if the program doesn't have any.
+	BuildInfo *buildinfo.BuildInfo
+
+	// Names are the names of the events created for the program.
+	Names *Mangler
+
+	// PID is the process being debugged, if the Prog was created
+	// from a running process, and Maps are its memory mappings.
+	PID  int
+	Maps []Mapping
+
+	path   string
+	closer io.Closer // file the Prog is read from, if opened by godebug
+	arch   *arch
+	load   uint64
+	bias   uint64   // difference between run time and link time addresses
+	pcln   *pclntab // nil for binaries older than Go 1.16
+
+	debug     *elf.File // separate debug info, if stripped
+	debugPath string
+
+	data   map[*elf.Section][]byte
+	inl    map[string][]InlineSite // lazily built by inlineSites
+	goid   goidInfo
+	unsafe map[uint64]string // by entry PC, lazily built by initUnsafe
+	dwarf  dwarfInfo
+	impl   implInfo
+	frames map[uint64][]Frame // by PC, lazily filled by Frames
 }
 
+// NewProg returns the Prog that cmd will run.
 func NewProg(cmd *exec.Cmd) (*Prog, error) {
 	file := cmd.Path
 	if !filepath.IsAbs(file) {
-		file = cmd.Dir + cmd.Path
+		file = filepath.Join(cmd.Dir, cmd.Path)
 	}
-	f, err := elf.Open(file)
+	return newProg(file)
+}
+
+func newProg(file string) (*Prog, error) {
+	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
-	symdat, err := f.Section(".gosymtab").Data()
+	prg, err := NewProgFromReader(f, file)
 	if err != nil {
 		f.Close()
-		return nil, fmt.Errorf("reading %s gosymtab: %v", file, err)
+		return nil, err
 	}
-	pclndat, err := f.Section(".gopclntab").Data()
+	prg.closer = f
+	return prg, nil
+}
+
+// NewProgFromReader returns the Prog in the ELF file read from r, which
+// must stay readable until the Prog is closed. path is where the file
+// lives, or would live. It names the program in errors and in probes,
+// and separate debug info and shared libraries are looked up relative
+// to it.
+func NewProgFromReader(r io.ReaderAt, path string) (*Prog, error) {
+	f, err := elf.NewFile(r)
 	if err != nil {
-		f.Close()
-		return nil, fmt.Errorf("reading %s gopclntab: %v", file, err)
+		return nil, err
 	}
-
-	pcln := gosym.NewLineTable(pclndat, f.Section(".text").Addr)
-	tab, err := gosym.NewTable(symdat, pcln)
+	a, err := lookupArch(f)
 	if err != nil {
-		f.Close()
-		return nil, fmt.Errorf("parsing %s gosymtab: %v", file, err)
+		return nil, fmt.Errorf("%s: %v", path, err)
 	}
 	prg := &Prog{
-		File: f,
-		Table: tab,
-		load: ProgLoadAddr(f),
-		path: file,
+		File:  f,
+		Names: NewMangler(),
+		path:  path,
+		arch:  a,
+	}
+	if stripped(f) {
+		prg.debug, prg.debugPath, _ = findDebugFile(f, path)
+	}
+	if err := prg.readBuildInfo(r); err != nil {
+		prg.Close()
+		return nil, err
+	}
+	if err := prg.loadTables(); err != nil {
+		prg.Close()
+		return nil, err
 	}
 	return prg, nil
 }
 
+// loadTables loads the Go symbol tables, from the separate debug info
+// file if the program doesn't have them. Addresses and offsets always
+// come from the program.
+func (p *Prog) loadTables() error {
+	// Recent binaries don't have a .gosymtab, everything is in
+	// .gopclntab.
+	var symdat []byte
+	var err error
+	if s := section(p.File, p.debug, ".gosymtab"); s != nil {
+		symdat, err = s.Data()
+		if err != nil {
+			return fmt.Errorf("reading %s gosymtab: %v", p.path, err)
+		}
+	}
+	s := section(p.File, p.debug, ".gopclntab")
+	if s == nil {
+		return fmt.Errorf("%s has no gopclntab", p.path)
+	}
+	pclndat, err := s.Data()
+	if err != nil {
+		return fmt.Errorf("reading %s gopclntab: %v", p.path, err)
+	}
+
+	syms, _ := p.Symbols()
+	if len(syms) == 0 && p.debug != nil {
+		syms, _ = p.debug.Symbols()
+	}
+	var text uint64
+	if s := p.Section(".text"); s != nil {
+		text = s.Addr
+	} else if p.debug != nil && p.debug.Section(".text") != nil {
+		text = p.debug.Section(".text").Addr
+	}
+	// With external linking, C code can come before the Go code in
+	// .text, which starts at runtime.text.
+	for _, s := range syms {
+		if s.Name == "runtime.text" {
+			text = s.Value
+			break
+		}
+	}
+	pcln := gosym.NewLineTable(pclndat, text)
+	p.Table, err = gosym.NewTable(symdat, pcln)
+	if err != nil {
+		return fmt.Errorf("parsing %s gosymtab: %v", p.path, err)
+	}
+	p.load, err = ProgLoadAddr(p.File)
+	if err != nil {
+		return fmt.Errorf("%s: %v", p.path, err)
+	}
+	p.pcln, err = newPclntab(pclndat, text)
+	switch {
+	case err == errPclntabVersion:
+		// Older programs are traced without the runtime metadata.
+	case err != nil:
+		return fmt.Errorf("parsing %s gopclntab: %v", p.path, err)
+	default:
+		p.pcln.gofunc = goFuncAddr(syms)
+	}
+	return nil
+}
+
+// Close closes the program and its separate debug info file.
+func (p *Prog) Close() error {
+	if p.debug != nil {
+		p.debug.Close()
+	}
+	err := p.File.Close()
+	if p.closer != nil {
+		err = p.closer.Close()
+	}
+	return err
+}
+
+// goFuncAddr returns the address of the go:func.* symbol, the base of
+// funcdata offsets, or 0 if it can't be found.
+func goFuncAddr(syms []elf.Symbol) uint64 {
+	for _, s := range syms {
+		// Before Go 1.20 the symbol was called go.func.*.
+		if s.Name == "go:func.*" || s.Name == "go.func.*" {
+			return s.Value
+		}
+	}
+	return 0
+}
+
+// read returns n bytes of initialized data at address addr in the
+// memory image.
+func (p *Prog) read(addr uint64, n int) ([]byte, error) {
+	for _, s := range p.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Type == elf.SHT_NOBITS {
+			continue
+		}
+		if addr < s.Addr || addr+uint64(n) > s.Addr+s.Size {
+			continue
+		}
+		b, err := p.sectionData(s)
+		if err != nil {
+			return nil, err
+		}
+		return b[addr-s.Addr:][:n], nil
+	}
+	return nil, fmt.Errorf("address %#x not in %s", addr, p.path)
+}
+
+// sectionData returns the contents of s, which is read only once.
+func (p *Prog) sectionData(s *elf.Section) ([]byte, error) {
+	if b, ok := p.data[s]; ok {
+		return b, nil
+	}
+	b, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+	if p.data == nil {
+		p.data = make(map[*elf.Section][]byte)
+	}
+	p.data[s] = b
+	return b, nil
+}
+
 // FuncOffset returns the offset of the named function in the memory
 // image. This offset is used by uprobes.
 func (p *Prog) FuncOffset(name string) uint64 {
@@ -86,16 +261,102 @@ func FuncOffset(fn *gosym.Func, load uint64) uint64 {
 }
 
 // Uprobe will return an uprobes event suitable for tracing the specified
-// function.
+// function. The event fetches the arguments of the function, as far as
+// the runtime symbol table describes them.
 func Uprobe(p *Prog, fn *gosym.Func) *uprobes.Event {
-	ev := uprobes.NewEvent(Uglify(fn.Name), p.path, FuncOffset(fn, p.load)).Stack("h0", 1).U64().Stack("d0", 1).S64().Stack("h1", 2).U64().Stack("d1", 2).S64().Stack("h2", 3).U64().Stack("d2", 3).S64().Stack("h3", 4).U64().Stack("d3", 4).S64()
-	return ev
+	ev := p.uprobe(fn, p.Names.Name(fn.Name, ""))
+	return p.describe(ev, "call of %s", p.Describe(fn))
+}
+
+func (p *Prog) uprobe(fn *gosym.Func, name string) *uprobes.Event {
+	ev := uprobes.NewEvent(name, p.path, FuncOffset(fn, p.load))
+	params := p.paramVars(fn, false)
+	for _, a := range p.frameArgs(fn) {
+		h := uprobes.Arg{Name: "h" + a.name, Type: sized(a.size, false), Value: a.val}
+		d := uprobes.Arg{Name: "d" + a.name, Type: sized(a.size, true), Value: a.val}
+		// Only the fetch with the signedness of the argument gets
+		// its name.
+		switch expr, signed, ok := argExpr(params, a.path); {
+		case ok && signed:
+			d.Expr = expr
+		case ok:
+			h.Expr = expr
+		default:
+			h.Expr = "arg" + a.name
+		}
+		ev.FetchArgs = append(ev.FetchArgs, h, d)
+	}
+	return p.withGoid(ev, fn.Entry, true)
+}
+
+// InlineUprobes will return uprobes events suitable for tracing the
+// calls of the named function that have been inlined. There are no
+// uretprobes counterparts, inlined code doesn't return. Inlined calls
+// don't have their arguments in a known place, so the events don't
+// fetch anything. Sites in functions that are not safe to probe are
+// left out, see Prog.Unsafe.
+func InlineUprobes(p *Prog, name string) ([]*uprobes.Event, error) {
+	sites, err := p.InlineSites(name)
+	if err != nil {
+		return nil, err
+	}
+	var evs []*uprobes.Event
+	for i, s := range sites {
+		if fn := p.PCToFunc(s.PC); fn != nil && p.Unsafe(fn) != "" {
+			continue
+		}
+		ev := uprobes.NewEvent(p.Names.Name(name, fmt.Sprintf("_inl%d", i)), p.path, s.PC-p.load)
+		p.describe(ev, "inlined call of %s at %s:%d in %s", name, s.File, s.Line, s.Caller)
+		evs = append(evs, p.withGoid(ev, s.PC, false))
+	}
+	return evs, nil
+}
+
+// LineUprobes will return uprobes events suitable for tracing execution
+// of the specified source line, one for every offset returned by
+// p.LineOffsets.
+func LineUprobes(p *Prog, file string, line int) ([]*uprobes.Event, error) {
+	offs, err := p.LineOffsets(file, line)
+	if err != nil {
+		return nil, err
+	}
+	pos := fmt.Sprintf("%s:%d", file, line)
+	evs := make([]*uprobes.Event, len(offs))
+	for i, off := range offs {
+		var suffix string
+		if len(offs) > 1 {
+			suffix = fmt.Sprintf("_%d", i)
+		}
+		ev := uprobes.NewEvent(p.Names.Name(pos, suffix), p.path, off)
+		if fn := p.PCToFunc(off + p.load); fn != nil {
+			p.describe(ev, "line %s in %s", pos, p.Describe(fn))
+		} else {
+			p.describe(ev, "line %s", pos)
+		}
+		evs[i] = p.withGoid(ev, off+p.load, false)
+	}
+	return evs, nil
 }
 
 // UretProbe will return an uretprobe event suitable for tracing the
-// specified function return.
+// specified function return. The event fetches the results of the
+// function passed in integer registers, as far as the debug info
+// describes them.
 func UretProbe(p *Prog, fn *gosym.Func) *uprobes.Event {
-	ev := uprobes.NewEvent(Uglify(fn.Name)+"_ret", p.path, FuncOffset(fn, p.load)).Return()
+	ev := p.uretprobe(fn, p.Names.Name(fn.Name, "_ret"))
+	return p.describe(ev, "return from %s", p.Describe(fn))
+}
+
+func (p *Prog) uretprobe(fn *gosym.Func, name string) *uprobes.Event {
+	ev := uprobes.NewEvent(name, p.path, FuncOffset(fn, p.load)).Return()
+	ev.FetchArgs = append(ev.FetchArgs, p.resultArgs(fn)...)
+	return p.withGoid(ev, fn.Entry, false)
+}
+
+// describe sets the description of ev, a probe of p, and returns ev.
+func (p *Prog) describe(ev *uprobes.Event, format string, args ...any) *uprobes.Event {
+	ev.Desc = fmt.Sprintf(format, args...)
+	p.Names.Describe(ev.Name, ev.Desc)
 	return ev
 }
 
@@ -103,7 +364,9 @@ var ugly = regexp.MustCompile(`[^a-zA-Z0-9_]`)
 
 // Uglify takes a nice Go name like net/http.(*response).WriteHeader and
 // turns it into net__http______response____WriteHeader. This is because
-// uprobes can only accept these retarded names.
+// uprobes can only accept these retarded names. Different names can
+// have the same ugly name, the events created by this package use
+// Prog.Names instead.
 func Uglify(name string) string {
 	return ugly.ReplaceAllLiteralString(name, "__")
 }
@@ -0,0 +1,432 @@
+package godebug
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"mgk.ro/godebug/godebugtest"
+)
+
+// testFuncs are the functions of the synthetic programs of the tests.
+var testFuncs = []godebugtest.Func{{
+	Name:  "main.main",
+	File:  "/src/main.go",
+	Lines: []int{5, 6, 7, 7},
+	Frame: 16,
+}, {
+	Name:  "main.handle",
+	File:  "/src/main.go",
+	Lines: []int{10, 11, 12, 11, 12},
+	Frame: 24,
+	Args:  []int{8, 4, 1},
+}, {
+	Name:  "main.outer",
+	File:  "/src/main.go",
+	Lines: []int{20, 21, 3, 4, 22, 22},
+	Frame: 8,
+	// main.small is inlined at the second instruction, on line 21.
+	Inlined:  []godebugtest.InlinedCall{{Func: "main.small", StartLine: 2, Call: 1}},
+	InlIndex: []int{-1, -1, 0, 0, -1, -1},
+}, {
+	Name:  "main.leaf",
+	File:  "/src/leaf.go",
+	Lines: []int{30, 30},
+}}
+
+// insnSize is the size of the instructions of the synthetic programs.
+var insnSize = map[string]uint64{"amd64": 1, "386": 1, "arm64": 4, "riscv64": 4}
+
+func testProg(t *testing.T, arch string, noRegABI bool) *Prog {
+	t.Helper()
+	b, err := godebugtest.Build(&godebugtest.Prog{Arch: arch, NoRegABI: noRegABI, Funcs: testFuncs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProgFromReader(bytes.NewReader(b), "/bin/prog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestUprobe(t *testing.T) {
+	tests := []struct {
+		arch     string
+		noRegABI bool
+		probe    string
+		retprobe string
+	}{
+		{"amd64", false,
+			"p:main_handle /bin/prog:0x1010 h0=%ax:u64 d0=%ax:s64 h1=%bx:u32 d1=%bx:s32 h2=%cx:u8 d2=%cx:s8 goid=+152(%r14):u64",
+			"r:main_handle_ret /bin/prog:0x1010 goid=+152(%r14):u64"},
+		// Without the register ABI, amd64 has g in thread local
+		// storage, which the synthetic code doesn't load.
+		{"amd64", true,
+			"p:main_handle /bin/prog:0x1010 h0=+8(%sp):u64 d0=+8(%sp):s64 h1=+16(%sp):u32 d1=+16(%sp):s32 h2=+24(%sp):u8 d2=+24(%sp):s8",
+			"r:main_handle_ret /bin/prog:0x1010"},
+		{"386", false,
+			"p:main_handle /bin/prog:0x1010 h0=+4(%sp):u64 d0=+4(%sp):s64 h1=+12(%sp):u32 d1=+12(%sp):s32 h2=+16(%sp):u8 d2=+16(%sp):s8",
+			"r:main_handle_ret /bin/prog:0x1010"},
+		{"arm64", false,
+			"p:main_handle /bin/prog:0x1010 h0=%x0:u64 d0=%x0:s64 h1=%x1:u32 d1=%x1:s32 h2=%x2:u8 d2=%x2:s8 goid=+152(%x28):u64",
+			"r:main_handle_ret /bin/prog:0x1010 goid=+152(%x28):u64"},
+		{"arm64", true,
+			"p:main_handle /bin/prog:0x1010 h0=+8(%sp):u64 d0=+8(%sp):s64 h1=+16(%sp):u32 d1=+16(%sp):s32 h2=+24(%sp):u8 d2=+24(%sp):s8 goid=+152(%x28):u64",
+			"r:main_handle_ret /bin/prog:0x1010 goid=+152(%x28):u64"},
+		{"riscv64", false,
+			"p:main_handle /bin/prog:0x1010 h0=%a0:u64 d0=%a0:s64 h1=%a1:u32 d1=%a1:s32 h2=%a2:u8 d2=%a2:s8 goid=+152(%s11):u64",
+			"r:main_handle_ret /bin/prog:0x1010 goid=+152(%s11):u64"},
+	}
+	for _, tt := range tests {
+		p := testProg(t, tt.arch, tt.noRegABI)
+		if off := p.FuncOffset("main.handle"); off != 0x1010 {
+			t.Errorf("%s: FuncOffset(main.handle) = %#x, want 0x1010", tt.arch, off)
+		}
+		fn := p.LookupFunc("main.handle")
+		if got := strings.TrimSpace(Uprobe(p, fn).String()); got != tt.probe {
+			t.Errorf("%s, noregabi %v: Uprobe =\n\t%s\nwant\n\t%s", tt.arch, tt.noRegABI, got, tt.probe)
+		}
+		if got := strings.TrimSpace(UretProbe(p, fn).String()); got != tt.retprobe {
+			t.Errorf("%s, noregabi %v: UretProbe =\n\t%s\nwant\n\t%s", tt.arch, tt.noRegABI, got, tt.retprobe)
+		}
+	}
+}
+
+func TestLineOffsets(t *testing.T) {
+	for arch, n := range insnSize {
+		p := testProg(t, arch, false)
+		handle := p.FuncOffset("main.handle")
+		tests := []struct {
+			file string
+			line int
+			want []uint64 // in instructions from main.handle
+		}{
+			{"/src/main.go", 10, []uint64{0}},
+			// Every run of instructions of the line.
+			{"/src/main.go", 11, []uint64{1, 3}},
+			{"main.go", 12, []uint64{2, 4}},
+		}
+		for _, tt := range tests {
+			offs, err := p.LineOffsets(tt.file, tt.line)
+			if err != nil {
+				t.Errorf("%s: LineOffsets(%s, %d): %v", arch, tt.file, tt.line, err)
+				continue
+			}
+			var want []uint64
+			for _, i := range tt.want {
+				want = append(want, handle+i*n)
+			}
+			if !reflect.DeepEqual(offs, want) {
+				t.Errorf("%s: LineOffsets(%s, %d) = %#x, want %#x", arch, tt.file, tt.line, offs, want)
+			}
+		}
+		if _, err := p.LineOffsets("other.go", 1); err == nil {
+			t.Errorf("%s: LineOffsets(other.go, 1) succeeded", arch)
+		}
+	}
+}
+
+func TestReturnOffsets(t *testing.T) {
+	for arch, n := range insnSize {
+		p := testProg(t, arch, false)
+		for _, tt := range []struct {
+			name string
+			want uint64
+		}{
+			{"main.handle", p.FuncOffset("main.handle") + 4*n},
+			// No frame.
+			{"main.leaf", p.FuncOffset("main.leaf") + n},
+		} {
+			offs, err := p.ReturnOffsets(p.LookupFunc(tt.name))
+			if err != nil {
+				t.Errorf("%s: ReturnOffsets(%s): %v", arch, tt.name, err)
+				continue
+			}
+			if want := []uint64{tt.want}; !reflect.DeepEqual(offs, want) {
+				t.Errorf("%s: ReturnOffsets(%s) = %#x, want %#x", arch, tt.name, offs, want)
+			}
+		}
+	}
+}
+
+func TestInlineSites(t *testing.T) {
+	for arch, n := range insnSize {
+		p := testProg(t, arch, false)
+		sites, err := p.InlineSites("main.small")
+		if err != nil {
+			t.Fatalf("%s: %v", arch, err)
+		}
+		want := []InlineSite{{
+			Func:   "main.small",
+			Caller: "main.outer",
+			Outer:  "main.outer",
+			PC:     p.PC(p.FuncOffset("main.outer") + 2*n),
+			File:   "/src/main.go",
+			Line:   21,
+		}}
+		if !reflect.DeepEqual(sites, want) {
+			t.Errorf("%s: InlineSites(main.small) = %+v, want %+v", arch, sites, want)
+		}
+		names, err := p.InlinedFuncs()
+		if err != nil {
+			t.Fatalf("%s: %v", arch, err)
+		}
+		if want := []string{"main.small"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("%s: InlinedFuncs() = %q, want %q", arch, names, want)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	for arch, n := range insnSize {
+		p := testProg(t, arch, false)
+		outer := p.FuncOffset("main.outer")
+		tests := []struct {
+			off  uint64
+			want string
+		}{
+			{outer + n, "main.outer /src/main.go:21"},
+			{outer + 3*n, "main.small /src/main.go:4 (inlined); main.outer /src/main.go:21"},
+			{outer + 4*n, "main.outer /src/main.go:22"},
+			{p.FuncOffset("main.leaf"), "main.leaf /src/leaf.go:30"},
+			{0x800, ""},
+		}
+		for _, tt := range tests {
+			var fs []string
+			for _, f := range p.Frames(p.PC(tt.off)) {
+				fs = append(fs, f.String())
+			}
+			if got := strings.Join(fs, "; "); got != tt.want {
+				t.Errorf("%s: Frames(%#x) = %q, want %q", arch, p.PC(tt.off), got, tt.want)
+			}
+		}
+	}
+}
+
+func TestSymbolizerCopy(t *testing.T) {
+	p := testProg(t, "amd64", false)
+	// Run time addresses, which are link time ones, and with the
+	// sym-userobj option, offsets in the file. Return addresses
+	// are symbolized at the call, before them.
+	trace := `prog-1234    [001] d....  100.000000: main_handle: (0x401010)
+ => <0000000000401023>
+ => <0000000000401012>
+ => <00007f0000001000>
+ => /bin/prog[+0x1031] <0000000000401031>
+prog-1234    [001] d....  100.000001: main_handle: (0x401010)
+ => /bin/prog[+0x1030] <0000000000401030>
+`
+	want := `prog-1234    [001] d....  100.000000: main_handle: (0x401010)
+ => main.small /src/main.go:4 (inlined)
+ => main.outer /src/main.go:21
+ => main.handle /src/main.go:11
+ => <00007f0000001000>
+ => main.leaf /src/leaf.go:30
+prog-1234    [001] d....  100.000001: main_handle: (0x401010)
+ => main.leaf /src/leaf.go:30
+`
+	var b bytes.Buffer
+	if err := NewSymbolizer(p).Copy(&b, strings.NewReader(trace)); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != want {
+		t.Errorf("Copy wrote\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMangler(t *testing.T) {
+	long := "example.com/" + strings.Repeat("a", 80) + ".F"
+	names := func(m *Mangler) []string {
+		return []string{
+			m.Name("main.(*T).f", ""),
+			m.Name("main.(*T).f", "_ret"),
+			// Collides with main.(*T).f.
+			m.Name("main.T.f", ""),
+			m.Name(long, "_ret"),
+			m.Name("io.Writer.Write(*os.File)", ""),
+		}
+	}
+	m := NewMangler()
+	got := names(m)
+	want := []*regexp.Regexp{
+		regexp.MustCompile(`^main_T_f$`),
+		regexp.MustCompile(`^main_T_f_ret$`),
+		regexp.MustCompile(`^main_T_f_[0-9a-f]{8}$`),
+		// The end of the symbol is kept.
+		regexp.MustCompile(`^a+_F_[0-9a-f]{8}_ret$`),
+		// The method and the type apart.
+		regexp.MustCompile(`^io_Writer_Write_os_File$`),
+	}
+	for i, name := range got {
+		if !want[i].MatchString(name) || len(name) > MaxEventName {
+			t.Errorf("event name %q doesn't match %s or is longer than %d", name, want[i], MaxEventName)
+		}
+	}
+	if got[3] != m.Name(long, "_ret") {
+		t.Errorf("second name of %s is %s, first was %s", long, m.Name(long, "_ret"), got[3])
+	}
+	if k, ok := m.Demangle(got[2]); !ok || k != (Mangled{"main.T.f", ""}) {
+		t.Errorf("Demangle(%s) = %v, %v, want main.T.f", got[2], k, ok)
+	}
+	// The names don't depend on the Mangler, they are in the names
+	// tables of traces.
+	if again := names(NewMangler()); !reflect.DeepEqual(again, got) {
+		t.Errorf("another Mangler named the events %q, want %q", again, got)
+	}
+
+	m.Describe(got[0], "call of main.(*T).f")
+	var b bytes.Buffer
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := ReadMangler(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m2, m) {
+		t.Errorf("ReadMangler read %+v, wrote %+v", m2, m)
+	}
+}
+
+func TestFullName(t *testing.T) {
+	tests := []struct {
+		name, pkgPath, want string
+	}{
+		{"*http.response", "net/http", "*net/http.response"},
+		{"os.File", "os", "os.File"},
+		{"main.List[int]", "main", "main.List[int]"},
+		{"x.Map[string,x.T]", "example.com/x", "example.com/x.Map[string,x.T]"},
+		// Unnamed types keep their name.
+		{"[]x.T", "example.com/x", "[]x.T"},
+		{"*func(x.T)", "example.com/x", "*func(x.T)"},
+		{"error", "", "error"},
+	}
+	for _, tt := range tests {
+		if got := fullName(tt.name, tt.pkgPath); got != tt.want {
+			t.Errorf("fullName(%q, %q) = %q, want %q", tt.name, tt.pkgPath, got, tt.want)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	tests := []struct {
+		settings []string
+		err      string // in the error, if any
+	}{
+		{nil, ""},
+		{[]string{"-buildmode=pie", "-race=true", "CGO_ENABLED=1"}, ""},
+		{[]string{"-buildmode=c-shared"}, "-buildmode=c-shared"},
+		{[]string{"-buildmode=plugin"}, "-buildmode=plugin"},
+		{[]string{"-compiler=gccgo"}, "-compiler=gccgo"},
+		{[]string{"GOOS=windows"}, "GOOS=windows"},
+	}
+	for _, tt := range tests {
+		b, err := godebugtest.Build(&godebugtest.Prog{Arch: "amd64", Settings: tt.settings, Funcs: testFuncs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewProgFromReader(bytes.NewReader(b), "/bin/prog")
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: %v", tt.settings, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%q: got error %v, want one about %s", tt.settings, err, tt.err)
+		}
+	}
+}
+
+// failingReader fails the reads from off on.
+type failingReader struct {
+	r   io.ReaderAt
+	off int64
+}
+
+var errRead = errors.New("read error")
+
+func (r failingReader) ReadAt(b []byte, off int64) (int, error) {
+	if off+int64(len(b)) > r.off {
+		return 0, errRead
+	}
+	return r.r.ReadAt(b, off)
+}
+
+func TestBuildInfoReadError(t *testing.T) {
+	b, err := godebugtest.Build(&godebugtest.Prog{Arch: "amd64", Funcs: testFuncs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := failingReader{bytes.NewReader(b), int64(f.Section(".go.buildinfo").Offset)}
+	if _, err := NewProgFromReader(r, "/bin/prog"); err == nil || !strings.Contains(err.Error(), errRead.Error()) {
+		t.Errorf("NewProgFromReader with the build info unreadable: got error %v, want %v", err, errRead)
+	}
+}
+
+func TestNoLoadAddr(t *testing.T) {
+	b, err := godebugtest.Build(&godebugtest.Prog{Arch: "amd64", Funcs: testFuncs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make the code segment not executable.
+	phoff := binary.LittleEndian.Uint64(b[32:])
+	binary.LittleEndian.PutUint32(b[phoff+4:], uint32(elf.PF_R))
+	if _, err := NewProgFromReader(bytes.NewReader(b), "/bin/prog"); err == nil || !strings.Contains(err.Error(), "load address") {
+		t.Errorf("NewProgFromReader without code segment: got error %v, want one about the load address", err)
+	}
+}
+
+func TestBadPclntab(t *testing.T) {
+	b, err := godebugtest.Build(&godebugtest.Prog{Arch: "amd64", Funcs: testFuncs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A pointer size of 3 bytes.
+	b[f.Section(".gopclntab").Offset+7] = 3
+	if _, err := NewProgFromReader(bytes.NewReader(b), "/bin/prog"); err == nil || !strings.Contains(err.Error(), "pointer size") {
+		t.Errorf("NewProgFromReader with a bad gopclntab: got error %v, want one about the pointer size", err)
+	}
+}
+
+func TestSelectorRecv(t *testing.T) {
+	tests := []struct {
+		sel  string
+		name string
+		want bool
+	}{
+		{"recv:*response", "net/http.(*response).Write", true},
+		{"recv:*response", "net/http.response.Write", false},
+		{"recv:*response", "net/http.(*bufferedResponse).Write", false},
+		{"recv:response", "net/http.response.Write", true},
+		{"recv:response", "net/http.(*response).Write", false},
+		{"recv:*resp*", "net/http.(*response).Write", true},
+		{"recv:**", "net/http.(*response).Write", true},
+		{"recv:**", "net/http.response.Write", false},
+		{"recv:*", "net/http.(*response).Write", true},
+		{"recv:*", "net/http.response.Write", true},
+		{"recv:*", "net/http.Write", false},
+		{"!recv:*response", "net/http.response.Write", true},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelector(tt.sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sel.Match(tt.name, ""); got != tt.want {
+			t.Errorf("%s matching %s: got %v, want %v", tt.sel, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+/*
+Package godebugtest builds small synthetic Go programs, for testing code
+that reads Go binaries, like package godebug, the same way on every
+machine, whatever Go toolchain is installed, if any.
+
+A synthetic program is an ELF executable with the Go runtime symbol
+table, a symbol table and build information, describing functions
+made of no-op instructions. It can't run. For example
+
+	b, err := godebugtest.Build(&godebugtest.Prog{
+		Arch: "amd64",
+		Funcs: []godebugtest.Func{{
+			Name:  "main.handle",
+			File:  "/src/main.go",
+			Lines: []int{10, 11, 11, 12},
+			Frame: 24,
+			Args:  []int{8, 8},
+		}},
+	})
+	...
+	prg, err := godebug.NewProgFromReader(bytes.NewReader(b), "/bin/prog")
+*/
+package godebugtest // import "mgk.ro/godebug/godebugtest"
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A Prog describes a synthetic program.
+type Prog struct {
+	Arch      string   // amd64, 386, arm64 or riscv64
+	GoVersion string   // like go1.22.1, go1.22.0 if empty
+	NoRegABI  bool     // arguments are passed on the stack, as with GOEXPERIMENT=noregabi
+	Settings  []string // more build settings, like -buildmode=pie
+	Funcs     []Func   // in the order they are laid out
+}
+
+// A Func is a function of a synthetic program.
+type Func struct {
+	Name string // like main.main
+	File string // source file
+
+	// Lines are the source lines of the instructions of the function,
+	// one per instruction, the first one being the line of the func
+	// keyword.
+	Lines []int
+
+	// Frame is the size of the frame, which the first instruction
+	// allocates and the one before last releases. The last
+	// instruction returns.
+	Frame int
+
+	// Args are the sizes of the arguments, in bytes, as the argument
+	// info the runtime uses for tracebacks describes them. Nil if
+	// the function has no argument info.
+	Args []int
+
+	// Inlined are the calls inlined into the function, and InlIndex
+	// the index in Inlined of the innermost inlined call of every
+	// instruction, or -1, one per instruction like Lines. Nil if
+	// nothing was inlined.
+	Inlined  []InlinedCall
+	InlIndex []int
+}
+
+// An InlinedCall is a call the compiler has inlined.
+type InlinedCall struct {
+	Func      string // name of the called function
+	StartLine int    // line of the func keyword of the called function
+
+	// Call is the index of an instruction of the calling code at
+	// the call site, whose inline index, in the InlIndex of the
+	// function, tells which call the call site is inlined in.
+	Call int
+}
+
+// An arch is what Build needs to know about a machine.
+type arch struct {
+	machine elf.Machine
+	ptrSize int
+	base    uint64 // link address of the start of the file
+	nop     []byte
+	ret     []byte
+	pad     byte // filler between functions
+}
+
+var arches = map[string]arch{
+	"amd64":   {elf.EM_X86_64, 8, 0x400000, []byte{0x90}, []byte{0xc3}, 0xcc},
+	"386":     {elf.EM_386, 4, 0x8048000, []byte{0x90}, []byte{0xc3}, 0xcc},
+	"arm64":   {elf.EM_AARCH64, 8, 0x10000, []byte{0x1f, 0x20, 0x03, 0xd5}, []byte{0xc0, 0x03, 0x5f, 0xd6}, 0},
+	"riscv64": {elf.EM_RISCV, 8, 0x10000, []byte{0x13, 0x00, 0x00, 0x00}, []byte{0x67, 0x80, 0x00, 0x00}, 0},
+}
+
+// Layout of the file. Every segment starts on its own page, and is
+// mapped at the link address of the start of the file plus its offset.
+const (
+	page      = 0x1000
+	funcAlign = 16
+)
+
+// Constants of the Go 1.20 runtime symbol table, see
+// internal/abi/symtab.go in the Go distribution.
+const (
+	go120magic         = 0xfffffff1
+	pcdataInlTreeIndex = 2
+	funcdataInlTree    = 3
+	funcdataArgInfo    = 5
+	argInfoEndSeq      = 0xff
+	argInfoMaxOffset   = 0xfa
+)
+
+// Build returns the ELF executable of the program p.
+func Build(p *Prog) ([]byte, error) {
+	a, ok := arches[p.Arch]
+	if !ok {
+		return nil, fmt.Errorf("unsupported GOARCH %q", p.Arch)
+	}
+	if len(p.Funcs) == 0 {
+		return nil, errors.New("no functions")
+	}
+	w := &writer{a: a, bo: binary.LittleEndian}
+
+	// Code.
+	var text []byte
+	entries := make([]uint64, len(p.Funcs))
+	for i, fn := range p.Funcs {
+		if len(fn.Lines) == 0 {
+			return nil, fmt.Errorf("%s has no instructions", fn.Name)
+		}
+		if fn.InlIndex != nil && len(fn.InlIndex) != len(fn.Lines) {
+			return nil, fmt.Errorf("%s: %d inline indices for %d instructions", fn.Name, len(fn.InlIndex), len(fn.Lines))
+		}
+		for len(text)%funcAlign != 0 {
+			text = append(text, a.pad)
+		}
+		entries[i] = uint64(len(text))
+		for range fn.Lines[1:] {
+			text = append(text, a.nop...)
+		}
+		text = append(text, a.ret...)
+	}
+	textOff := uint64(page)
+	textAddr := a.base + textOff
+
+	// Read only data: the argument info and the inline trees, at
+	// go:func.*, then the runtime symbol table.
+	rodataOff := align(textOff+uint64(len(text)), page)
+	var funcdata []byte
+	argInfo := make([]int64, len(p.Funcs))
+	inlTree := make([]int64, len(p.Funcs))
+	for i, fn := range p.Funcs {
+		inlTree[i] = -1
+		if fn.Inlined != nil {
+			for len(funcdata)%4 != 0 {
+				funcdata = append(funcdata, 0)
+			}
+			inlTree[i] = int64(len(funcdata))
+			// Names are added to the function name table after
+			// those of the functions.
+			funcdata = append(funcdata, make([]byte, 16*len(fn.Inlined))...)
+		}
+		argInfo[i] = -1
+		if fn.Args == nil {
+			continue
+		}
+		argInfo[i] = int64(len(funcdata))
+		off := 0
+		for _, size := range fn.Args {
+			if off > argInfoMaxOffset || size > 0xff {
+				return nil, fmt.Errorf("%s: arguments too large", fn.Name)
+			}
+			funcdata = append(funcdata, byte(off), byte(size))
+			off += int(align(uint64(size), uint64(a.ptrSize)))
+		}
+		funcdata = append(funcdata, argInfoEndSeq)
+	}
+	pclnOff := align(rodataOff+uint64(len(funcdata)), 8)
+	pcln := w.pclntab(p, entries, argInfo, inlTree, funcdata, uint64(len(text)))
+
+	// Data.
+	dataOff := align(pclnOff+uint64(len(pcln)), page)
+	buildinfo := w.buildInfo(p)
+
+	// Symbols.
+	var syms []symbol
+	syms = append(syms, symbol{name: "runtime.text", value: textAddr, typ: elf.STT_FUNC, shndx: 1})
+	for i, fn := range p.Funcs {
+		end := uint64(len(text))
+		if i+1 < len(p.Funcs) {
+			end = entries[i+1]
+		}
+		syms = append(syms, symbol{name: fn.Name, value: textAddr + entries[i], size: end - entries[i], typ: elf.STT_FUNC, shndx: 1})
+	}
+	syms = append(syms,
+		symbol{name: "runtime.etext", value: textAddr + uint64(len(text)), typ: elf.STT_FUNC, shndx: 1},
+		symbol{name: "go:func.*", value: a.base + rodataOff, typ: elf.STT_OBJECT, shndx: 2})
+
+	alloc := []section{
+		{name: ".text", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR, off: textOff, data: text, align: funcAlign},
+		{name: ".rodata", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC, off: rodataOff, data: funcdata, align: 8},
+		{name: ".gopclntab", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC, off: pclnOff, data: pcln, align: 8},
+		{name: ".go.buildinfo", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_WRITE, off: dataOff, data: buildinfo, align: 16},
+	}
+	progs := []segment{
+		{flags: elf.PF_R | elf.PF_X, off: 0, size: textOff + uint64(len(text))},
+		{flags: elf.PF_R, off: rodataOff, size: pclnOff + uint64(len(pcln)) - rodataOff},
+		{flags: elf.PF_R | elf.PF_W, off: dataOff, size: uint64(len(buildinfo))},
+	}
+	return w.file(alloc, progs, syms, dataOff+uint64(len(buildinfo)))
+}
+
+// A writer writes the parts of a synthetic program for an arch.
+type writer struct {
+	a  arch
+	bo binary.ByteOrder
+}
+
+func align(n, a uint64) uint64 {
+	return (n + a - 1) &^ (a - 1)
+}
+
+// pclntab returns the runtime symbol table of p, whose functions start
+// at entries in a text segment of size textSize. argInfo and inlTree
+// are the offsets of the argument info and of the inline tree of the
+// functions in funcdata, at go:func.*, or -1. pclntab fills in the
+// inline trees, which refer to the function name table.
+func (w *writer) pclntab(p *Prog, entries []uint64, argInfo, inlTree []int64, funcdata []byte, textSize uint64) []byte {
+	var funcnames, filetab, pctab bytes.Buffer
+	var cutab []uint32
+	files := make(map[string]int) // index in cutab
+	pctab.WriteByte(0)            // offset 0 is no table
+
+	type funcMeta struct {
+		nameOff, pcsp, pcfile, pcln, pcinl uint32
+	}
+	metas := make([]funcMeta, len(p.Funcs))
+	for i, fn := range p.Funcs {
+		metas[i].nameOff = uint32(funcnames.Len())
+		funcnames.WriteString(fn.Name)
+		funcnames.WriteByte(0)
+		fileno, ok := files[fn.File]
+		if !ok {
+			fileno = len(cutab)
+			files[fn.File] = fileno
+			cutab = append(cutab, uint32(filetab.Len()))
+			filetab.WriteString(fn.File)
+			filetab.WriteByte(0)
+		}
+		n := len(fn.Lines)
+		sp := make([]int, n)
+		if fn.Frame != 0 && n >= 3 {
+			for j := 1; j < n-1; j++ {
+				sp[j] = fn.Frame
+			}
+		}
+		file := make([]int, n)
+		for j := range file {
+			file[j] = fileno
+		}
+		metas[i].pcsp = uint32(pctab.Len())
+		pctab.Write(pcvalue(sp))
+		metas[i].pcfile = uint32(pctab.Len())
+		pctab.Write(pcvalue(file))
+		metas[i].pcln = uint32(pctab.Len())
+		pctab.Write(pcvalue(fn.Lines))
+		if fn.InlIndex != nil {
+			metas[i].pcinl = uint32(pctab.Len())
+			pctab.Write(pcvalue(fn.InlIndex))
+		}
+	}
+	// The inline trees, as internal/abi.InlinedCall.
+	for i, fn := range p.Funcs {
+		for j, c := range fn.Inlined {
+			b := funcdata[inlTree[i]+16*int64(j):]
+			w.bo.PutUint32(b[4:], uint32(funcnames.Len()))
+			w.bo.PutUint32(b[8:], uint32(c.Call*len(w.a.nop)))
+			w.bo.PutUint32(b[12:], uint32(c.StartLine))
+			funcnames.WriteString(c.Func)
+			funcnames.WriteByte(0)
+		}
+	}
+
+	// The function table, entry and _func offset pairs followed by the
+	// end of the text, then the _func records.
+	var functab bytes.Buffer
+	nfunc := len(p.Funcs)
+	funcOff := uint32(4 * (2*nfunc + 1))
+	var funcs bytes.Buffer
+	for i, fn := range p.Funcs {
+		binary.Write(&functab, w.bo, uint32(entries[i]))
+		binary.Write(&functab, w.bo, funcOff+uint32(funcs.Len()))
+
+		args := int32(0)
+		for _, size := range fn.Args {
+			args += int32(align(uint64(size), uint64(w.a.ptrSize)))
+		}
+		var npcdata uint32
+		var nfuncdata uint8
+		if inlTree[i] >= 0 {
+			npcdata, nfuncdata = pcdataInlTreeIndex+1, funcdataInlTree+1
+		}
+		if argInfo[i] >= 0 {
+			nfuncdata = funcdataArgInfo + 1
+		}
+		m := metas[i]
+		for _, v := range []uint32{
+			uint32(entries[i]), m.nameOff, uint32(args), 0, // entryOff, nameOff, args, deferreturn
+			m.pcsp, m.pcfile, m.pcln, npcdata, 0, // cuOffset
+			uint32(fn.Lines[0]), // startLine
+		} {
+			binary.Write(&funcs, w.bo, v)
+		}
+		funcs.Write([]byte{0, 0, 0, nfuncdata}) // funcID, flag, padding, nfuncdata
+		for j := 0; j < int(npcdata); j++ {
+			var off uint32
+			if j == pcdataInlTreeIndex {
+				off = m.pcinl
+			}
+			binary.Write(&funcs, w.bo, off)
+		}
+		for j := 0; j < int(nfuncdata); j++ {
+			off := ^uint32(0)
+			switch {
+			case j == funcdataInlTree && inlTree[i] >= 0:
+				off = uint32(inlTree[i])
+			case j == funcdataArgInfo:
+				off = uint32(argInfo[i])
+			}
+			binary.Write(&funcs, w.bo, off)
+		}
+	}
+	binary.Write(&functab, w.bo, uint32(textSize))
+	functab.Write(funcs.Bytes())
+
+	// Header, then the tables.
+	ps := w.a.ptrSize
+	hdrSize := 8 + 8*ps
+	var cu bytes.Buffer
+	binary.Write(&cu, w.bo, cutab)
+	offs := []int{hdrSize}
+	for _, b := range [][]byte{funcnames.Bytes(), cu.Bytes(), filetab.Bytes(), pctab.Bytes()} {
+		offs = append(offs, offs[len(offs)-1]+len(b))
+	}
+	var t bytes.Buffer
+	binary.Write(&t, w.bo, uint32(go120magic))
+	t.Write([]byte{0, 0, byte(len(w.a.nop)), byte(ps)}) // the quantum is the size of the instructions
+	for _, v := range []int{nfunc, len(cutab), 0, offs[0], offs[1], offs[2], offs[3], offs[4]} {
+		w.word(&t, uint64(v))
+	}
+	t.Write(funcnames.Bytes())
+	t.Write(cu.Bytes())
+	t.Write(filetab.Bytes())
+	t.Write(pctab.Bytes())
+	t.Write(functab.Bytes())
+	return t.Bytes()
+}
+
+// pcvalue encodes vals, the values at every instruction of a function,
+// as a pcvalue table. PC deltas are in quanta, which are instructions.
+func pcvalue(vals []int) []byte {
+	var b []byte
+	prev := -1
+	for i := 0; i < len(vals); {
+		j := i + 1
+		for j < len(vals) && vals[j] == vals[i] {
+			j++
+		}
+		b = binary.AppendUvarint(b, zigzag(vals[i]-prev))
+		b = binary.AppendUvarint(b, uint64(j-i))
+		prev = vals[i]
+		i = j
+	}
+	return append(b, 0)
+}
+
+func zigzag(v int) uint64 {
+	if v < 0 {
+		return uint64(^v)<<1 | 1
+	}
+	return uint64(v) << 1
+}
+
+// buildInfo returns the contents of the .go.buildinfo section, the Go
+// version and the module information, written inline as in Go 1.18 and
+// later.
+func (w *writer) buildInfo(p *Prog) []byte {
+	vers := p.GoVersion
+	if vers == "" {
+		vers = "go1.22.0"
+	}
+	mod := "path\tcommand-line-arguments\nbuild\tGOARCH=" + p.Arch + "\n"
+	if p.NoRegABI {
+		mod += "build\tGOEXPERIMENT=noregabi\n"
+	}
+	for _, s := range p.Settings {
+		mod += "build\t" + s + "\n"
+	}
+	// The module information is framed by sentinels, see
+	// cmd/go/internal/modload.
+	mod = "0w\xaf\f\x92t\b\x02A\xe1\xc1\a\xe6\xd6\x18\xe6" + mod + "\xf92C1\x86\x18 r\x00\x82B\x10A\x16\xd8\xf2"
+
+	b := make([]byte, 32)
+	copy(b, "\xff Go buildinf:")
+	b[14] = byte(w.a.ptrSize)
+	b[15] = 2 // strings inline, little endian
+	b = binary.AppendUvarint(b, uint64(len(vers)))
+	b = append(b, vers...)
+	b = binary.AppendUvarint(b, uint64(len(mod)))
+	return append(b, mod...)
+}
+
+func (w *writer) word(b *bytes.Buffer, v uint64) {
+	if w.a.ptrSize == 4 {
+		binary.Write(b, w.bo, uint32(v))
+	} else {
+		binary.Write(b, w.bo, v)
+	}
+}
+
+// A section is an allocated section of a synthetic program.
+type section struct {
+	name  string
+	typ   elf.SectionType
+	flags elf.SectionFlag
+	off   uint64
+	data  []byte
+	align uint64
+}
+
+// A segment is a loadable segment of a synthetic program.
+type segment struct {
+	flags     elf.ProgFlag
+	off, size uint64
+}
+
+type symbol struct {
+	name        string
+	value, size uint64
+	typ         elf.SymType
+	shndx       uint16
+}
+
+// file lays out the ELF file: the header and the program headers, the
+// allocated sections, which end at end, then the symbol table, the
+// string tables and the section headers.
+func (w *writer) file(alloc []section, progs []segment, syms []symbol, end uint64) ([]byte, error) {
+	is64 := w.a.ptrSize == 8
+	ehSize, phSize, shSize, symSize := 52, 32, 40, 16
+	if is64 {
+		ehSize, phSize, shSize, symSize = 64, 56, 64, 24
+	}
+	if uint64(ehSize+len(progs)*phSize) > alloc[0].off {
+		return nil, errors.New("too many program headers")
+	}
+
+	var strtab, shstrtab bytes.Buffer
+	strtab.WriteByte(0)
+	shstrtab.WriteByte(0)
+	str := func(b *bytes.Buffer, s string) uint32 {
+		off := uint32(b.Len())
+		b.WriteString(s)
+		b.WriteByte(0)
+		return off
+	}
+	var symtab bytes.Buffer
+	symtab.Write(make([]byte, symSize))
+	for _, s := range syms {
+		name := str(&strtab, s.name)
+		info := elf.ST_INFO(elf.STB_GLOBAL, s.typ)
+		if is64 {
+			binary.Write(&symtab, w.bo, elf.Sym64{Name: name, Info: info, Shndx: s.shndx, Value: s.value, Size: s.size})
+		} else {
+			binary.Write(&symtab, w.bo, elf.Sym32{Name: name, Value: uint32(s.value), Size: uint32(s.size), Info: info, Shndx: s.shndx})
+		}
+	}
+
+	type shdr struct {
+		section
+		link, info uint32
+		entsize    uint64
+	}
+	shdrs := []shdr{{}}
+	for _, s := range alloc {
+		shdrs = append(shdrs, shdr{section: s})
+	}
+	off := end
+	next := func(data []byte, a uint64) uint64 {
+		o := align(off, a)
+		off = o + uint64(len(data))
+		return o
+	}
+	nalloc := uint32(len(shdrs))
+	shdrs = append(shdrs,
+		shdr{section: section{name: ".symtab", typ: elf.SHT_SYMTAB, data: symtab.Bytes(), align: 8}, link: nalloc + 1, info: 1, entsize: uint64(symSize)},
+		shdr{section: section{name: ".strtab", typ: elf.SHT_STRTAB, data: strtab.Bytes(), align: 1}},
+		shdr{section: section{name: ".shstrtab", typ: elf.SHT_STRTAB, align: 1}})
+	names := make([]uint32, len(shdrs))
+	for i, s := range shdrs[1:] {
+		names[i+1] = str(&shstrtab, s.name)
+	}
+	shdrs[len(shdrs)-1].data = shstrtab.Bytes()
+	for i := int(nalloc); i < len(shdrs); i++ {
+		shdrs[i].off = next(shdrs[i].data, shdrs[i].align)
+	}
+	shoff := align(off, 8)
+	size := shoff + uint64(len(shdrs)*shSize)
+
+	b := make([]byte, size)
+	for _, s := range shdrs {
+		copy(b[s.off:], s.data)
+	}
+	var h bytes.Buffer
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS32), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	if is64 {
+		ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+		binary.Write(&h, w.bo, elf.Header64{
+			Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(w.a.machine), Version: uint32(elf.EV_CURRENT),
+			Entry: w.a.base + alloc[0].off, Phoff: uint64(ehSize), Shoff: shoff,
+			Ehsize: uint16(ehSize), Phentsize: uint16(phSize), Phnum: uint16(len(progs)),
+			Shentsize: uint16(shSize), Shnum: uint16(len(shdrs)), Shstrndx: uint16(len(shdrs) - 1),
+		})
+		for _, p := range progs {
+			binary.Write(&h, w.bo, elf.Prog64{
+				Type: uint32(elf.PT_LOAD), Flags: uint32(p.flags), Off: p.off,
+				Vaddr: w.a.base + p.off, Paddr: w.a.base + p.off, Filesz: p.size, Memsz: p.size, Align: page,
+			})
+		}
+	} else {
+		binary.Write(&h, w.bo, elf.Header32{
+			Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(w.a.machine), Version: uint32(elf.EV_CURRENT),
+			Entry: uint32(w.a.base + alloc[0].off), Phoff: uint32(ehSize), Shoff: uint32(shoff),
+			Ehsize: uint16(ehSize), Phentsize: uint16(phSize), Phnum: uint16(len(progs)),
+			Shentsize: uint16(shSize), Shnum: uint16(len(shdrs)), Shstrndx: uint16(len(shdrs) - 1),
+		})
+		for _, p := range progs {
+			binary.Write(&h, w.bo, elf.Prog32{
+				Type: uint32(elf.PT_LOAD), Off: uint32(p.off), Vaddr: uint32(w.a.base + p.off), Paddr: uint32(w.a.base + p.off),
+				Filesz: uint32(p.size), Memsz: uint32(p.size), Flags: uint32(p.flags), Align: page,
+			})
+		}
+	}
+	copy(b, h.Bytes())
+
+	var sh bytes.Buffer
+	for i, s := range shdrs {
+		var addr uint64
+		if s.flags&elf.SHF_ALLOC != 0 {
+			addr = w.a.base + s.off
+		}
+		if is64 {
+			binary.Write(&sh, w.bo, elf.Section64{
+				Name: names[i], Type: uint32(s.typ), Flags: uint64(s.flags), Addr: addr, Off: s.off,
+				Size: uint64(len(s.data)), Link: s.link, Info: s.info, Addralign: s.align, Entsize: s.entsize,
+			})
+		} else {
+			binary.Write(&sh, w.bo, elf.Section32{
+				Name: names[i], Type: uint32(s.typ), Flags: uint32(s.flags), Addr: uint32(addr), Off: uint32(s.off),
+				Size: uint32(len(s.data)), Link: s.link, Info: s.info, Addralign: uint32(s.align), Entsize: uint32(s.entsize),
+			})
+		}
+	}
+	copy(b[shoff:], sh.Bytes())
+	return b, nil
+}
@@ -0,0 +1,136 @@
+package godebug
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"errors"
+	"fmt"
+
+	"mgk.ro/uprobes"
+)
+
+// GoidOffset returns the offset of the goid field in runtime.g, the
+// goroutine ID. It is read from DWARF if possible, otherwise guessed from
+// the Go version that built the program.
+func (p *Prog) GoidOffset() (uint64, error) {
+	p.initGoid()
+	return p.goid.off, p.goid.err
+}
+
+// goidInfo caches what's needed to fetch the goroutine ID.
+type goidInfo struct {
+	done bool
+	off  uint64
+	err  error
+	reg  string // register holding g, see gRegister
+}
+
+func (p *Prog) initGoid() {
+	if p.goid.done {
+		return
+	}
+	p.goid.done = true
+	p.goid.off, p.goid.err = p.goidOffset()
+	p.goid.reg = p.gRegister()
+}
+
+func (p *Prog) goidOffset() (uint64, error) {
+	if d, err := p.DWARF(); err == nil {
+		r := d.Reader()
+		for {
+			e, err := r.Next()
+			if err != nil || e == nil {
+				break
+			}
+			if e.Tag == dwarf.TagSubprogram {
+				r.SkipChildren()
+			}
+			if e.Tag != dwarf.TagStructType || e.Val(dwarf.AttrName) != "runtime.g" {
+				continue
+			}
+			t, err := d.Type(e.Offset)
+			if err != nil {
+				return 0, err
+			}
+			for _, f := range t.(*dwarf.StructType).Field {
+				if f.Name == "goid" {
+					return uint64(f.ByteOffset), nil
+				}
+			}
+			return 0, errors.New("runtime.g has no goid")
+		}
+	}
+	minor, ok := p.minor()
+	if !ok {
+		return 0, errors.New("no DWARF and unknown Go version")
+	}
+	var off uint64
+	for _, v := range p.arch.goidOffsets {
+		if minor >= v.minor {
+			off = v.off
+		}
+	}
+	if off == 0 {
+		return 0, fmt.Errorf("no DWARF and unknown goid offset for %s on %v", p.GoVersion(), p.Machine)
+	}
+	return off, nil
+}
+
+// gRegister returns the register that holds g in Go code, or "" if the
+// program keeps g in thread local storage.
+func (p *Prog) gRegister() string {
+	a := p.arch
+	if a.gReg != "" || a.regabiGReg == "" {
+		return a.gReg
+	}
+	// Since Go 1.17, the register ABI keeps g in R14 on amd64. Before
+	// that, runtime.main loaded it from TLS in its prologue.
+	if regabi, known := p.regabi(); known {
+		if regabi {
+			return a.regabiGReg
+		}
+		return ""
+	}
+	if fn := p.LookupFunc("runtime.main"); fn != nil {
+		if _, _, ok := p.tlsPrologue(fn.Entry); ok {
+			return ""
+		}
+	}
+	return a.regabiGReg
+}
+
+// tlsPrologue looks at the function starting at entry for a prologue
+// that loads g from thread local storage, and returns the register that
+// holds g after the prologue and the length of the prologue.
+func (p *Prog) tlsPrologue(entry uint64) (reg string, n uint64, ok bool) {
+	for _, pro := range p.arch.tlsPrologues {
+		b, err := p.read(entry, len(pro))
+		if err == nil && bytes.Equal(b, pro) {
+			return "cx", uint64(len(pro)), true
+		}
+	}
+	return "", 0, false
+}
+
+// withGoid adds a goid fetch arg to ev, which probes the code at pc.
+// If g lives in thread local storage, function entry probes are moved
+// past the prologue that loads g. Other probes, including uretprobes,
+// don't get a goid then. ev is left alone if the goid can't be found.
+func (p *Prog) withGoid(ev *uprobes.Event, pc uint64, entry bool) *uprobes.Event {
+	off, err := p.GoidOffset()
+	if err != nil {
+		return ev
+	}
+	if reg := p.goid.reg; reg != "" {
+		return ev.RegisterOffset("goid", reg, off).U64()
+	}
+	if !entry || ev.Kind != uprobes.Probe {
+		return ev
+	}
+	reg, n, ok := p.tlsPrologue(pc)
+	if !ok {
+		return ev
+	}
+	ev.Offset += n
+	return ev.RegisterOffset("goid", reg, off).U64()
+}
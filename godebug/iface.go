@@ -0,0 +1,423 @@
+package godebug
+
+import (
+	"debug/gosym"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go/token"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"mgk.ro/uprobes"
+)
+
+// An Impl is a concrete type that implements an interface.
+type Impl struct {
+	Iface string // interface, like io.Writer or net/http.Handler
+	Type  string // concrete type, like *os.File or *net/http.response
+
+	// Methods are the functions called through the interface, in
+	// the order of the methods of the interface. Methods of value
+	// receivers are called through wrappers when Type is a pointer.
+	Methods []*gosym.Func
+}
+
+// implInfo caches the runtime types of the program.
+type implInfo struct {
+	done   bool
+	ifaces map[string]rtype // named interfaces, by name
+	types  []rtype          // concrete types with methods, sorted by name
+	text   uint64           // address of runtime.text
+	err    error
+}
+
+// An rtype is a runtime type of the program, with its methods.
+type rtype struct {
+	name    string // with the package path, like *net/http.response
+	pkgPath string
+	// The methods of concrete types, sorted by name, or of
+	// interfaces.
+	methods []rmethod
+}
+
+// An rmethod is a method of a runtime type, abi.Method or abi.Imethod in
+// Go.
+type rmethod struct {
+	name string
+	typ  int32 // type of the method, as an offset from runtime.types
+	ifn  int32 // function called through interfaces, as an offset from runtime.text, or -1
+}
+
+// Implementations returns the concrete types of the program that
+// implement the named interface, like io.Writer or net/http.Handler, and
+// their methods. Types are named with their package path.
+//
+// The types are found in the runtime type data of the program, so types
+// only converted to the interface at run time, by type assertions or
+// reflection, are found too. Types whose methods the linker removed, as
+// they can't be called through an interface, are left out. A value type
+// and its pointer type calling the same functions through the interface
+// are the same Impl, named after the pointer type.
+func (p *Prog) Implementations(iface string) ([]Impl, error) {
+	p.initImpls()
+	if p.impl.err != nil {
+		return nil, p.impl.err
+	}
+	it, ok := p.impl.ifaces[iface]
+	if !ok {
+		return nil, nil
+	}
+	var impls []Impl
+	seen := make(map[string]bool) // by methods
+	for _, t := range p.impl.types {
+		im, ok := p.implements(t, it)
+		if !ok {
+			continue
+		}
+		var key strings.Builder
+		for _, fn := range im.Methods {
+			fmt.Fprintf(&key, "%x ", fn.Entry)
+		}
+		if !seen[key.String()] {
+			seen[key.String()] = true
+			impls = append(impls, im)
+		}
+	}
+	return impls, nil
+}
+
+// implements returns the Impl of interface it by type t, if t implements
+// it, as the runtime decides it: by name, package for unexported
+// methods, and type of the methods.
+func (p *Prog) implements(t, it rtype) (Impl, bool) {
+	im := Impl{Iface: it.name, Type: t.name}
+	for _, m := range it.methods {
+		i := sort.Search(len(t.methods), func(i int) bool { return t.methods[i].name >= m.name })
+		if i == len(t.methods) || t.methods[i].name != m.name || t.methods[i].typ != m.typ {
+			return Impl{}, false
+		}
+		if !token.IsExported(m.name) && t.pkgPath != it.pkgPath {
+			return Impl{}, false
+		}
+		if t.methods[i].ifn < 0 {
+			return Impl{}, false
+		}
+		fn := p.PCToFunc(p.impl.text + uint64(t.methods[i].ifn))
+		if fn == nil {
+			return Impl{}, false
+		}
+		im.Methods = append(im.Methods, fn)
+	}
+	return im, true
+}
+
+// initImpls reads the runtime types of the program. There is no table
+// of them, so initImpls looks through the type data of the program for
+// their shape: a valid kind, name and method table.
+func (p *Prog) initImpls() {
+	if p.impl.done {
+		return
+	}
+	p.impl.done = true
+	syms, err := p.Symbols()
+	if err != nil {
+		p.impl.err = fmt.Errorf("can't find types: %v", err)
+		return
+	}
+	var types, etypes, text, etext uint64
+	for _, s := range syms {
+		switch s.Name {
+		case "runtime.types":
+			types = s.Value
+		case "runtime.etypes":
+			etypes = s.Value
+		case "runtime.text":
+			text = s.Value
+		case "runtime.etext":
+			etext = s.Value
+		}
+	}
+	if types == 0 || etypes <= types || text == 0 || etext <= text {
+		p.impl.err = errors.New("can't find types: no runtime.types or runtime.text symbol")
+		return
+	}
+	data, err := p.read(types, int(etypes-types))
+	if err != nil {
+		p.impl.err = fmt.Errorf("can't read types: %v", err)
+		return
+	}
+	p.impl.text = text
+	t := &typeReader{p: p, types: types, data: data, ps: p.ptrSize(), textSize: etext - text}
+	p.impl.ifaces = make(map[string]rtype)
+	for off := 0; off+t.typeSize() <= len(data); off += t.ps {
+		rt, kind, ok := t.rtype(off)
+		switch {
+		case !ok:
+		case kind == kindInterface:
+			p.impl.ifaces[rt.name] = rt
+		case len(rt.methods) > 0:
+			p.impl.types = append(p.impl.types, rt)
+		}
+	}
+	sort.Slice(p.impl.types, func(i, j int) bool { return p.impl.types[i].name < p.impl.types[j].name })
+}
+
+// typeReader reads the runtime types of the program, in data, which
+// runs from runtime.types to runtime.etypes.
+type typeReader struct {
+	p        *Prog
+	types    uint64 // address of runtime.types
+	data     []byte
+	ps       int    // pointer size
+	textSize uint64 // from runtime.text to runtime.etext
+}
+
+// Kinds of types, see internal/abi/type.go in the Go distribution.
+const (
+	kindArray     = 17
+	kindChan      = 18
+	kindFunc      = 19
+	kindInterface = 20
+	kindMap       = 21
+	kindPointer   = 22
+	kindSlice     = 23
+	kindStruct    = 25
+	kindMax       = 26 // unsafe.Pointer
+	kindMask      = 1<<5 - 1
+)
+
+// Flags of types.
+const (
+	tflagUncommon  = 1 << 0
+	tflagExtraStar = 1 << 1 // the name has a leading * that's not part of it
+	tflagNamed     = 1 << 2
+)
+
+// Offsets in the header of runtime types, abi.Type in Go.
+func (t *typeReader) tflagOff() int { return 2*t.ps + 4 }
+func (t *typeReader) kindOff() int  { return 2*t.ps + 7 }
+func (t *typeReader) strOff() int   { return 4*t.ps + 8 }
+func (t *typeReader) typeSize() int { return t.strOff() + 8 }
+
+// uncommonOffs returns the possible offsets of the uncommon type data,
+// abi.UncommonType, which follows the data of the kind of type. The
+// layout of map types changes from release to release, so there are
+// several.
+func (t *typeReader) uncommonOffs(kind int) []int {
+	align := func(n int) int { return (n + t.ps - 1) &^ (t.ps - 1) }
+	size, ps := t.typeSize(), t.ps
+	switch kind {
+	case kindStruct, kindInterface:
+		return []int{size + 4*ps}
+	case kindPointer, kindSlice:
+		return []int{size + ps}
+	case kindArray:
+		return []int{size + 3*ps}
+	case kindChan:
+		return []int{size + 2*ps}
+	case kindFunc:
+		return []int{align(size + 4)}
+	case kindMap:
+		// Before Go 1.24, then Swiss tables, then Swiss tables with
+		// split key and element arrays.
+		return []int{size + 4*ps + 8, align(size + 7*ps + 4), align(size + 10*ps + 4)}
+	}
+	return []int{size}
+}
+
+func (t *typeReader) int32(off int) (int32, bool) {
+	if off < 0 || off+4 > len(t.data) {
+		return 0, false
+	}
+	return int32(t.p.ByteOrder.Uint32(t.data[off:])), true
+}
+
+func (t *typeReader) uint16(off int) uint16 {
+	return t.p.ByteOrder.Uint16(t.data[off:])
+}
+
+func (t *typeReader) word(off int) uint64 {
+	if t.ps == 4 {
+		return uint64(t.p.ByteOrder.Uint32(t.data[off:]))
+	}
+	return t.p.ByteOrder.Uint64(t.data[off:])
+}
+
+// kind returns the kind of the type at off, or 0.
+func (t *typeReader) kind(off int32) int {
+	if off < 0 || int(off)+t.typeSize() > len(t.data) {
+		return 0
+	}
+	return int(t.data[int(off)+t.kindOff()] & kindMask)
+}
+
+// rtype decodes the type at off, if there's one with uncommon data,
+// which types with methods and named types have.
+func (t *typeReader) rtype(off int) (rtype, int, bool) {
+	tflag := t.data[off+t.tflagOff()]
+	kind := int(t.data[off+t.kindOff()] & kindMask)
+	if tflag&tflagUncommon == 0 || kind == 0 || kind > kindMax {
+		return rtype{}, 0, false
+	}
+	if kind == kindInterface && tflag&tflagNamed == 0 {
+		return rtype{}, 0, false
+	}
+	str, _ := t.int32(off + t.strOff())
+	name, ok := t.name(str)
+	if !ok {
+		return rtype{}, 0, false
+	}
+	if tflag&tflagExtraStar != 0 {
+		name = strings.TrimPrefix(name, "*")
+	}
+	for _, u := range t.uncommonOffs(kind) {
+		rt, ok := t.uncommon(off+u, kind == kindInterface)
+		if !ok {
+			continue
+		}
+		if kind == kindInterface {
+			rt.methods, ok = t.imethods(off)
+			if !ok {
+				continue
+			}
+		}
+		rt.name = fullName(name, rt.pkgPath)
+		return rt, kind, true
+	}
+	return rtype{}, 0, false
+}
+
+// uncommon decodes the uncommon type data at off, with the package path
+// and the methods of the type. Interfaces have no methods there.
+func (t *typeReader) uncommon(off int, iface bool) (rtype, bool) {
+	if off+16 > len(t.data) {
+		return rtype{}, false
+	}
+	var rt rtype
+	if pkg, _ := t.int32(off); pkg != 0 {
+		var ok bool
+		if rt.pkgPath, ok = t.name(pkg); !ok {
+			return rtype{}, false
+		}
+	}
+	mcount, xcount := int(t.uint16(off+4)), int(t.uint16(off+6))
+	moff := int(t.p.ByteOrder.Uint32(t.data[off+8:]))
+	if iface {
+		return rt, mcount == 0
+	}
+	if mcount == 0 || xcount > mcount || moff < 16 || off+moff+16*mcount > len(t.data) {
+		return rtype{}, false
+	}
+	for i := 0; i < mcount; i++ {
+		m := off + moff + 16*i
+		nameOff, _ := t.int32(m)
+		typ, _ := t.int32(m + 4)
+		ifn, _ := t.int32(m + 8)
+		tfn, _ := t.int32(m + 12)
+		name, ok := t.name(nameOff)
+		if !ok || typ != -1 && t.kind(typ) != kindFunc || !t.isTextOff(ifn) || !t.isTextOff(tfn) {
+			return rtype{}, false
+		}
+		rt.methods = append(rt.methods, rmethod{name: name, typ: typ, ifn: ifn})
+	}
+	sort.Slice(rt.methods, func(i, j int) bool { return rt.methods[i].name < rt.methods[j].name })
+	return rt, true
+}
+
+// imethods decodes the methods of the interface type at off, which are
+// followed by its package path and the slice of its methods.
+func (t *typeReader) imethods(off int) ([]rmethod, bool) {
+	types := t.types
+	s := off + t.typeSize() + t.ps
+	ptr, n, c := t.word(s), t.word(s+t.ps), t.word(s+2*t.ps)
+	if n != c || n > 1000 || n > 0 && (ptr < types || ptr+8*n > types+uint64(len(t.data))) {
+		return nil, false
+	}
+	var ms []rmethod
+	for i := uint64(0); i < n; i++ {
+		m := int(ptr - types + 8*i)
+		nameOff, _ := t.int32(m)
+		typ, _ := t.int32(m + 4)
+		name, ok := t.name(nameOff)
+		if !ok || t.kind(typ) != kindFunc {
+			return nil, false
+		}
+		ms = append(ms, rmethod{name: name, typ: typ, ifn: -1})
+	}
+	return ms, true
+}
+
+func (t *typeReader) isTextOff(off int32) bool {
+	return off == -1 || off >= 0 && uint64(off) < t.textSize
+}
+
+// name decodes the runtime name at off: a flags byte followed by the
+// length, a varint since Go 1.17 and big endian 16 bits before, and the
+// bytes of the name. Names are printable text.
+func (t *typeReader) name(off int32) (string, bool) {
+	if off <= 0 || int(off)+3 > len(t.data) {
+		return "", false
+	}
+	b := t.data[off:]
+	if b[0] >= 1<<4 {
+		return "", false
+	}
+	var n uint64
+	var hdr int
+	if minor, ok := t.p.minor(); ok && minor < 17 {
+		n, hdr = uint64(binary.BigEndian.Uint16(b[1:])), 3
+	} else {
+		var k int
+		n, k = binary.Uvarint(b[1:])
+		if k <= 0 {
+			return "", false
+		}
+		hdr = 1 + k
+	}
+	if n == 0 || uint64(hdr)+n > uint64(len(b)) {
+		return "", false
+	}
+	s := string(b[hdr : uint64(hdr)+n])
+	if !utf8.ValidString(s) || strings.ContainsFunc(s, func(r rune) bool { return r < ' ' || r == 0x7f }) {
+		return "", false
+	}
+	return s, true
+}
+
+// fullName returns the name of a type, as the runtime names it, like
+// *http.response, with the package path of the type instead of its
+// package name, like *net/http.response.
+func fullName(name, pkgPath string) string {
+	rest := strings.TrimLeft(name, "*")
+	stars := name[:len(name)-len(rest)]
+	i := strings.IndexByte(rest, '.')
+	if j := strings.IndexAny(rest, "[("); pkgPath == "" || i <= 0 || j >= 0 && j < i {
+		return name
+	}
+	return stars + pkgPath + rest[i:]
+}
+
+// ImplUprobe will return an uprobes event suitable for tracing calls of
+// fn, one of the methods of im. The event is named after the interface,
+// the method and the concrete type, as in io.Writer.Write(*os.File).
+func ImplUprobe(p *Prog, im Impl, fn *gosym.Func) *uprobes.Event {
+	ev := p.uprobe(fn, p.Names.Name(implSym(im, fn), ""))
+	return p.describe(ev, "call of %s (%s)", implDesc(im, fn), fn.Name)
+}
+
+// ImplUretProbe will return an uretprobe event suitable for tracing
+// returns from fn, one of the methods of im, see ImplUprobe.
+func ImplUretProbe(p *Prog, im Impl, fn *gosym.Func) *uprobes.Event {
+	ev := p.uretprobe(fn, p.Names.Name(implSym(im, fn), "_ret"))
+	return p.describe(ev, "return from %s (%s)", implDesc(im, fn), fn.Name)
+}
+
+func implSym(im Impl, fn *gosym.Func) string {
+	return fmt.Sprintf("%s.%s(%s)", im.Iface, SplitName(fn.Name).Func, im.Type)
+}
+
+func implDesc(im Impl, fn *gosym.Func) string {
+	return fmt.Sprintf("%s.%s on %s", im.Iface, SplitName(fn.Name).Func, im.Type)
+}
@@ -0,0 +1,163 @@
+package godebug
+
+import (
+	"sort"
+)
+
+// Indices of the inline tree tables in the pcdata and funcdata of a
+// function. See internal/abi/symtab.go in the Go distribution.
+const (
+	pcdataInlTreeIndex = 2
+	funcdataInlTree    = 3
+)
+
+// An InlineSite is a place where the compiler has inlined a call.
+type InlineSite struct {
+	Func   string // name of the inlined function
+	Caller string // name of the calling function, maybe inlined itself
+	Outer  string // name of the out-of-line function containing the code
+	PC     uint64 // lowest PC of the inlined code
+	File   string // position of the call
+	Line   int
+}
+
+// inlinedCall is an entry in the inline tree of a function.
+type inlinedCall struct {
+	parent   int    // index of the parent call, or -1
+	name     string // name of the called function
+	parentPc uint64 // offset from entry of an instruction at the call site
+}
+
+// inlinedCall returns the ith entry of the inline tree at address tree.
+// The inline index table ranges are needed to find the parent in Go 1.20
+// and later.
+func (p *Prog) inlinedCall(tree uint64, i int, fn *funcInfo, ranges []pcRange) (inlinedCall, error) {
+	t := p.pcln
+	if t.magic == go120magic {
+		b, err := p.read(tree+uint64(16*i), 16)
+		if err != nil {
+			return inlinedCall{}, err
+		}
+		c := inlinedCall{
+			parent:   -1,
+			name:     t.funcName(int32(t.bo.Uint32(b[4:]))),
+			parentPc: uint64(t.bo.Uint32(b[8:])),
+		}
+		// The parent is whatever was executing at the call site.
+		pc := fn.entry + c.parentPc
+		for _, r := range ranges {
+			if r.lo <= pc && pc < r.hi {
+				c.parent = int(r.val)
+				break
+			}
+		}
+		return c, nil
+	}
+	b, err := p.read(tree+uint64(20*i), 20)
+	if err != nil {
+		return inlinedCall{}, err
+	}
+	return inlinedCall{
+		parent:   int(int16(t.bo.Uint16(b))),
+		name:     t.funcName(int32(t.bo.Uint32(b[12:]))),
+		parentPc: uint64(t.bo.Uint32(b[16:])),
+	}, nil
+}
+
+// inlineSites returns all the inline sites in the program, indexed by
+// the name of the inlined function.
+func (p *Prog) inlineSites() (map[string][]InlineSite, error) {
+	if p.inl != nil {
+		return p.inl, nil
+	}
+	if p.pcln == nil {
+		return nil, errPclntabVersion
+	}
+	inl := make(map[string][]InlineSite)
+	for _, fn := range p.pcln.funcs() {
+		tree := fn.funcdata(funcdataInlTree)
+		if tree == 0 {
+			continue
+		}
+		ranges := p.pcln.pcvalues(fn.pcdata(pcdataInlTreeIndex), fn.entry)
+		calls := make(map[int]inlinedCall)
+		lowest := make(map[int]uint64)
+		for _, r := range ranges {
+			if r.lo == r.hi {
+				continue
+			}
+			// The inlined code of a call includes the code of
+			// everything inlined into it.
+			for i := int(r.val); i >= 0; {
+				c, ok := calls[i]
+				if !ok {
+					var err error
+					c, err = p.inlinedCall(tree, i, fn, ranges)
+					if err != nil {
+						return nil, err
+					}
+					calls[i] = c
+				}
+				if lo, ok := lowest[i]; !ok || r.lo < lo {
+					lowest[i] = r.lo
+				}
+				if c.parent == i {
+					break
+				}
+				i = c.parent
+			}
+		}
+		for i, c := range calls {
+			caller := fn.name()
+			if parent, ok := calls[c.parent]; ok {
+				caller = parent.name
+			}
+			file, line, _ := p.PCToLine(fn.entry + c.parentPc)
+			inl[c.name] = append(inl[c.name], InlineSite{
+				Func:   c.name,
+				Caller: caller,
+				Outer:  fn.name(),
+				PC:     lowest[i],
+				File:   file,
+				Line:   line,
+			})
+		}
+	}
+	for _, sites := range inl {
+		sort.Slice(sites, func(i, j int) bool { return sites[i].PC < sites[j].PC })
+	}
+	p.inl = inl
+	return inl, nil
+}
+
+// InlineSites returns all the places where the named function has been
+// inlined, sorted by PC.
+func (p *Prog) InlineSites(name string) ([]InlineSite, error) {
+	inl, err := p.inlineSites()
+	if err != nil {
+		return nil, err
+	}
+	return inl[name], nil
+}
+
+// InlinedFuncs returns the sorted names of the functions that have been
+// inlined into all their callers, so they don't have an out-of-line
+// body. Such functions can only be traced at their inline sites.
+func (p *Prog) InlinedFuncs() ([]string, error) {
+	inl, err := p.inlineSites()
+	if err != nil {
+		return nil, err
+	}
+	outofline := make(map[string]bool)
+	for _, fn := range p.Funcs {
+		outofline[fn.Name] = true
+	}
+	var names []string
+	for name := range inl {
+		if !outofline[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,79 @@
+package godebug
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LineOffsets returns the offsets in the memory image of the code
+// generated for the specified source line. These offsets are used by
+// uprobes.
+//
+// A line usually maps to more than one place in the program, because
+// the compiler reorders code and because the function containing it
+// might have been inlined into other functions. LineOffsets returns the
+// first PC of every contiguous run of instructions attributed to the
+// line, in ascending order.
+//
+// The file doesn't need to be a full path, any unambiguous suffix like
+// "server.go" or "http/server.go" will do.
+func (p *Prog) LineOffsets(file string, line int) ([]uint64, error) {
+	path, err := p.lookupFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pc, _, err := p.LineToPC(path, line)
+	if err != nil {
+		return nil, err
+	}
+	if p.pcln == nil {
+		return []uint64{pc - p.load}, nil
+	}
+	var offs []uint64
+	for _, fn := range p.pcln.funcs() {
+		files, lines := fn.fileLine()
+		prev := false
+		for i, j := 0, 0; i < len(files) && j < len(lines); {
+			f, l := files[i], lines[j]
+			match := l.val == int32(line) && p.pcln.fileName(fn.cuOffset(), f.val) == path
+			if match && !prev {
+				offs = append(offs, max(f.lo, l.lo)-p.load)
+			}
+			prev = match
+			switch {
+			case f.hi < l.hi:
+				i++
+			case l.hi < f.hi:
+				j++
+			default:
+				i++
+				j++
+			}
+		}
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	return offs, nil
+}
+
+// lookupFile returns the full path of the source file that ends in file.
+func (p *Prog) lookupFile(file string) (string, error) {
+	if _, ok := p.Files[file]; ok {
+		return file, nil
+	}
+	var found []string
+	for path := range p.Files {
+		if strings.HasSuffix(path, "/"+filepath.ToSlash(file)) {
+			found = append(found, path)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no source file %s in %s", file, p.path)
+	case 1:
+		return found[0], nil
+	}
+	sort.Strings(found)
+	return "", fmt.Errorf("ambiguous source file %s: %s", file, strings.Join(found, ", "))
+}
@@ -0,0 +1,221 @@
+package godebug
+
+import (
+	"debug/dwarf"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"mgk.ro/uprobes"
+)
+
+// LocalArgs returns the fetch args that read expr when the program is at
+// pc, and the type of the value read. expr is the name of a parameter or
+// of a local variable in scope at pc followed by field selectors, see
+// ExprArgs. Variables declared in inner blocks and in the bodies of
+// inlined calls hide the outer ones.
+//
+// Optimized code doesn't keep every variable everywhere; LocalArgs
+// returns an error saying so if the variable isn't available at pc, or
+// if its location uses a DWARF operation that can't be turned into a
+// uprobes fetch.
+func (p *Prog) LocalArgs(pc uint64, expr string) (uprobes.Args, dwarf.Type, error) {
+	if !exprSyntax.MatchString(expr) {
+		return nil, nil, fmt.Errorf("bad expression %q", expr)
+	}
+	fields := strings.Split(expr, ".")
+	if err := p.dwarfIndex(); err != nil {
+		return nil, nil, err
+	}
+	fn := p.PCToFunc(pc)
+	if fn == nil {
+		return nil, nil, fmt.Errorf("no function at %#x", pc)
+	}
+	df := p.dwarf.funcs[fn.Entry]
+	if df == nil {
+		return nil, nil, fmt.Errorf("%s: %w", fields[0], ErrNoVariable)
+	}
+	vs, err := p.varsAt(df, pc)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := len(vs) - 1; i >= 0; i-- {
+		if v := vs[i]; v.name == fields[0] {
+			cfa, err := p.cfa(pc)
+			if err != nil {
+				return nil, nil, err
+			}
+			return p.varArgs(df.cu, v, pc, cfa, expr, fields[1:])
+		}
+	}
+	return nil, nil, fmt.Errorf("%s: %w", fields[0], ErrNoVariable)
+}
+
+// PC returns the address of the code at offset off in the memory image,
+// the inverse of FuncOffset.
+func (p *Prog) PC(off uint64) uint64 {
+	return off + p.load
+}
+
+// varArgs returns the fetch args that read expr, which starts with the
+// variable v, at pc. cfa is the distance between SP and the CFA at pc.
+func (p *Prog) varArgs(cu *dwarf.Entry, v dwarfVar, pc uint64, cfa int64, expr string, fields []string) (uprobes.Args, dwarf.Type, error) {
+	loc, err := p.location(cu, v.e, pc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", v.name, err)
+	}
+	pieces, err := p.evalLocation(loc, cfa)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", v.name, err)
+	}
+	if pieces == nil {
+		return nil, nil, fmt.Errorf("%s is optimized out at %#x", v.name, pc)
+	}
+	return p.compileFields(expr, v.t, pieces, fields)
+}
+
+// varsAt returns the parameters and local variables of the function df
+// that are in scope at pc, outer scopes first.
+func (p *Prog) varsAt(df *dwarfEntry, pc uint64) ([]dwarfVar, error) {
+	d := p.dwarf.d
+	r := d.Reader()
+	r.Seek(df.e.Offset)
+	if _, err := r.Next(); err != nil {
+		return nil, err
+	}
+	var vs []dwarfVar
+	for depth := 1; depth > 0; {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		switch e.Tag {
+		case 0:
+			depth--
+			continue
+		case dwarf.TagLexDwarfBlock, dwarf.TagInlinedSubroutine:
+			rs, err := d.Ranges(e)
+			if err != nil {
+				return nil, err
+			}
+			if e.Children && inRanges(rs, pc) {
+				depth++
+				continue
+			}
+		case dwarf.TagFormalParameter, dwarf.TagVariable:
+			v, ok, err := p.newVar(e)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				vs = append(vs, v)
+			}
+		}
+		if e.Children {
+			r.SkipChildren()
+		}
+	}
+	return vs, nil
+}
+
+// newVar returns the variable described by e. Variables of inlined calls
+// get their name and type from their abstract origin.
+func (p *Prog) newVar(e *dwarf.Entry) (dwarfVar, bool, error) {
+	d := p.dwarf.d
+	attrs := e
+	if off, ok := e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset); ok {
+		r := d.Reader()
+		r.Seek(off)
+		o, err := r.Next()
+		if err != nil {
+			return dwarfVar{}, false, err
+		}
+		if o == nil {
+			return dwarfVar{}, false, nil
+		}
+		attrs = o
+	}
+	name, _ := attrs.Val(dwarf.AttrName).(string)
+	off, ok := attrs.Val(dwarf.AttrType).(dwarf.Offset)
+	if name == "" || !ok {
+		return dwarfVar{}, false, nil
+	}
+	t, err := d.Type(off)
+	if err != nil {
+		return dwarfVar{}, false, err
+	}
+	return dwarfVar{name: name, param: e.Tag == dwarf.TagFormalParameter, t: t, e: e}, true, nil
+}
+
+func inRanges(rs [][2]uint64, pc uint64) bool {
+	for _, r := range rs {
+		if r[0] <= pc && pc < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// cfa returns the distance between SP and the CFA at pc, from the stack
+// pointer deltas the toolchain records for the runtime.
+func (p *Prog) cfa(pc uint64) (int64, error) {
+	ra := p.arch.retAddrSize
+	if p.pcln == nil {
+		return 0, errors.New("no runtime symbol table, can't locate the frame")
+	}
+	f := p.pcln.funcFor(pc)
+	if f == nil {
+		return 0, fmt.Errorf("no function at %#x", pc)
+	}
+	for _, r := range p.pcln.pcvalues(f.pcsp(), f.entry) {
+		if r.lo <= pc && pc < r.hi {
+			return int64(r.val) + ra, nil
+		}
+	}
+	if pc == f.entry {
+		return ra, nil
+	}
+	return 0, fmt.Errorf("no stack pointer delta at %#x", pc)
+}
+
+// funcFor returns the metadata of the function containing pc, or nil.
+func (t *pclntab) funcFor(pc uint64) *funcInfo {
+	i := sort.Search(t.nfunc, func(i int) bool { return t.entryPC(i+1) > pc })
+	if i == t.nfunc || pc < t.entryPC(i) {
+		return nil
+	}
+	return t.funcAt(i)
+}
+
+// Names of the DWARF operations found in Go and C programs that
+// evalLocation can't handle.
+var opNames = map[byte]string{
+	0x12: "DW_OP_dup",
+	0x1a: "DW_OP_and",
+	0x1c: "DW_OP_minus",
+	0x1e: "DW_OP_mul",
+	0x94: "DW_OP_deref_size",
+	0x9e: "DW_OP_implicit_value",
+	0x9f: "DW_OP_stack_value",
+	0xa0: "DW_OP_implicit_pointer",
+	0xa3: "DW_OP_entry_value",
+	0xf3: "DW_OP_GNU_entry_value",
+}
+
+// unsupportedOp explains why the DWARF operation op can't be fetched.
+func unsupportedOp(op byte) error {
+	switch op {
+	case 0x9e, 0x9f:
+		return fmt.Errorf("value is computed, not stored (%s)", opNames[op])
+	case 0xa3, 0xf3:
+		return fmt.Errorf("value is only known relative to the caller (%s)", opNames[op])
+	}
+	if name, ok := opNames[op]; ok {
+		return fmt.Errorf("unsupported DWARF operation %s", name)
+	}
+	return fmt.Errorf("unsupported DWARF operation %#x", op)
+}
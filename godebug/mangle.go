@@ -0,0 +1,171 @@
+package godebug
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+)
+
+// MaxEventName is the maximum length of a trace event name accepted by
+// Linux.
+const MaxEventName = 63
+
+// A Mangler turns symbol names into trace event names. Unlike Uglify,
+// it produces names that are unique, no longer than MaxEventName and
+// that can be mapped back to the symbol.
+//
+// An event name is made of a readable rendering of the symbol followed
+// by a suffix describing the kind of the event, like "_ret". Names that
+// would collide or are too long get a hash of the symbol added.
+type Mangler struct {
+	events map[string]Mangled // by event name
+	names  map[Mangled]string // by symbol and suffix
+	descs  map[string]string  // by event name
+}
+
+// Mangled is what an event name stands for.
+type Mangled struct {
+	Symbol string // e.g. net/http.(*response).WriteHeader
+	Suffix string // e.g. _ret
+}
+
+// NewMangler returns an empty Mangler.
+func NewMangler() *Mangler {
+	return &Mangler{
+		events: make(map[string]Mangled),
+		names:  make(map[Mangled]string),
+		descs:  make(map[string]string),
+	}
+}
+
+// Name returns the event name for sym with the specified suffix, which
+// must only contain letters, digits and underscores. The same symbol
+// and suffix always get the same name.
+func (m *Mangler) Name(sym, suffix string) string {
+	key := Mangled{sym, suffix}
+	if name, ok := m.names[key]; ok {
+		return name
+	}
+	s := readable(sym)
+	name := s + suffix
+	for i := 0; len(name) > MaxEventName || m.taken(name); i++ {
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%s\x00%s\x00%d", sym, suffix, i)
+		hash := fmt.Sprintf("_%08x", h.Sum32())
+		name = fit(s, MaxEventName-len(suffix)-len(hash)) + hash + suffix
+	}
+	m.events[name] = key
+	m.names[key] = name
+	return name
+}
+
+func (m *Mangler) taken(name string) bool {
+	_, ok := m.events[name]
+	return ok
+}
+
+// Demangle returns the symbol and suffix the event name stands for.
+func (m *Mangler) Demangle(name string) (Mangled, bool) {
+	k, ok := m.events[name]
+	return k, ok
+}
+
+// Describe records a human readable description of the event name, for
+// trace renderers.
+func (m *Mangler) Describe(name, desc string) {
+	m.descs[name] = desc
+}
+
+// Desc returns the description of the event name, or "".
+func (m *Mangler) Desc(name string) string {
+	return m.descs[name]
+}
+
+// WriteTo writes the reverse table in a format understood by
+// ReadMangler: one event per line, with the event name, symbol, suffix
+// and description, if any, separated by tabs.
+func (m *Mangler) WriteTo(w io.Writer) (int64, error) {
+	events := make([]string, 0, len(m.events))
+	for name := range m.events {
+		events = append(events, name)
+	}
+	sort.Strings(events)
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, name := range events {
+		k := m.events[name]
+		line := name + "\t" + k.Symbol + "\t" + k.Suffix
+		if d := m.descs[name]; d != "" {
+			line += "\t" + d
+		}
+		nn, err := fmt.Fprintln(bw, line)
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// ReadMangler reads a reverse table written by Mangler.WriteTo.
+func ReadMangler(r io.Reader) (*Mangler, error) {
+	m := NewMangler()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Split(s.Text(), "\t")
+		if len(f) != 3 && len(f) != 4 {
+			return nil, fmt.Errorf("bad event name table line: %q", s.Text())
+		}
+		k := Mangled{f[1], f[2]}
+		m.events[f[0]] = k
+		m.names[k] = f[0]
+		if len(f) == 4 {
+			m.descs[f[0]] = f[3]
+		}
+	}
+	return m, s.Err()
+}
+
+// readable turns sym into a valid, readable event name, for example
+// net/http.(*response).WriteHeader becomes net_http_response_WriteHeader,
+// main.Map[go.shape.int] becomes main_Map_int and
+// io.Writer.Write(*os.File) becomes io_Writer_Write_os_File.
+func readable(sym string) string {
+	sym = strings.ReplaceAll(sym, "go.shape.", "")
+	var b strings.Builder
+	sep := false
+	for _, r := range sym {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			if sep && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+			sep = false
+		case r == '*' || r == ')' || r == ']':
+		default:
+			sep = true
+		}
+	}
+	s := b.String()
+	if s == "" || '0' <= s[0] && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+// fit shortens s to at most n bytes keeping its end, which is usually
+// the most specific part of a symbol.
+func fit(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[len(s)-n:]
+	if '0' <= s[0] && s[0] <= '9' {
+		s = "_" + s[1:]
+	}
+	return s
+}
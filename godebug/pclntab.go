@@ -0,0 +1,314 @@
+package godebug
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Magic numbers at the start of the Go 1.16+ runtime symbol table. See
+// internal/abi/symtab.go in the Go distribution.
+const (
+	go116magic = 0xfffffffa
+	go118magic = 0xfffffff0
+	go120magic = 0xfffffff1
+)
+
+var errPclntabVersion = errors.New("unsupported pclntab version (need Go 1.16 or later)")
+
+// pclntab decodes the runtime symbol table of Go 1.16 and later
+// binaries. Unlike debug/gosym it gives access to the raw per-function
+// metadata (pcdata and funcdata tables, flags, etc).
+type pclntab struct {
+	data      []byte
+	bo        binary.ByteOrder
+	magic     uint32
+	quantum   uint64
+	ptrsize   int
+	nfunc     int
+	textStart uint64
+	gofunc    uint64 // address of go:func.*, base of funcdata in Go 1.18+
+
+	funcnametab []byte
+	cutab       []byte
+	filetab     []byte
+	pctab       []byte
+	functab     []byte // also known as pclntable
+}
+
+// newPclntab parses the pclntab in data. Like in debug/gosym, text is
+// the address of the start of the text segment, the linker doesn't fill
+// the textStart field of the header in the file.
+func newPclntab(data []byte, text uint64) (*pclntab, error) {
+	if len(data) < 8 {
+		return nil, errors.New("pclntab too short")
+	}
+	t := &pclntab{data: data}
+	switch {
+	case isMagic(binary.LittleEndian.Uint32(data)):
+		t.bo = binary.LittleEndian
+	case isMagic(binary.BigEndian.Uint32(data)):
+		t.bo = binary.BigEndian
+	default:
+		return nil, errPclntabVersion
+	}
+	t.magic = t.bo.Uint32(data)
+	if data[4] != 0 || data[5] != 0 {
+		return nil, errors.New("bad pclntab header")
+	}
+	t.quantum = uint64(data[6])
+	t.ptrsize = int(data[7])
+	if t.ptrsize != 4 && t.ptrsize != 8 {
+		return nil, fmt.Errorf("bad pclntab pointer size %d", t.ptrsize)
+	}
+	word := func(n int) uint64 {
+		off := 8 + n*t.ptrsize
+		if off+t.ptrsize > len(data) {
+			return 0
+		}
+		return t.uintptr(data[off:])
+	}
+	t.nfunc = int(word(0))
+	// Go 1.18 added textStart after nfiles; everything else moved by
+	// one word.
+	n := 2
+	if t.magic != go116magic {
+		t.textStart = text
+		n = 3
+	}
+	offs := []uint64{word(n), word(n + 1), word(n + 2), word(n + 3), word(n + 4)}
+	for _, off := range offs {
+		if off > uint64(len(data)) {
+			return nil, errors.New("bad pclntab header")
+		}
+	}
+	t.funcnametab = data[offs[0]:]
+	t.cutab = data[offs[1]:]
+	t.filetab = data[offs[2]:]
+	t.pctab = data[offs[3]:]
+	t.functab = data[offs[4]:]
+	return t, nil
+}
+
+func isMagic(m uint32) bool {
+	return m == go116magic || m == go118magic || m == go120magic
+}
+
+func (t *pclntab) uintptr(b []byte) uint64 {
+	if t.ptrsize == 4 {
+		return uint64(t.bo.Uint32(b))
+	}
+	return t.bo.Uint64(b)
+}
+
+// functabFieldSize is the size of each of the two fields of a functab
+// entry, the entry PC and the offset of the _func.
+func (t *pclntab) functabFieldSize() int {
+	if t.magic == go116magic {
+		return t.ptrsize
+	}
+	return 4
+}
+
+// entryPC returns the entry PC of the ith function in the functab.
+// Index nfunc is valid and returns the end of the last function.
+func (t *pclntab) entryPC(i int) uint64 {
+	sz := t.functabFieldSize()
+	b := t.functab[2*i*sz:]
+	if t.magic == go116magic {
+		return t.uintptr(b)
+	}
+	return t.textStart + uint64(t.bo.Uint32(b))
+}
+
+// funcAt returns the metadata of the ith function in the functab.
+func (t *pclntab) funcAt(i int) *funcInfo {
+	sz := t.functabFieldSize()
+	b := t.functab[(2*i+1)*sz:]
+	var off uint64
+	if sz == 4 {
+		off = uint64(t.bo.Uint32(b))
+	} else {
+		off = t.uintptr(b)
+	}
+	return &funcInfo{t: t, b: t.functab[off:], entry: t.entryPC(i), end: t.entryPC(i + 1)}
+}
+
+// funcs returns the metadata of all the functions in the table, sorted
+// by entry PC.
+func (t *pclntab) funcs() []*funcInfo {
+	fns := make([]*funcInfo, t.nfunc)
+	for i := range fns {
+		fns[i] = t.funcAt(i)
+	}
+	return fns
+}
+
+// cstring returns the NUL-terminated string at the start of b.
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+// funcName returns the function name at offset off in funcnametab.
+func (t *pclntab) funcName(off int32) string {
+	if off < 0 || int(off) >= len(t.funcnametab) {
+		return ""
+	}
+	return cstring(t.funcnametab[off:])
+}
+
+// fileName returns the name of the fileno'th file of the compilation
+// unit starting at cuOffset.
+func (t *pclntab) fileName(cuOffset uint32, fileno int32) string {
+	if fileno < 0 {
+		return ""
+	}
+	i := 4 * (int(cuOffset) + int(fileno))
+	if i+4 > len(t.cutab) {
+		return ""
+	}
+	off := t.bo.Uint32(t.cutab[i:])
+	if off == ^uint32(0) || int(off) >= len(t.filetab) {
+		return ""
+	}
+	return cstring(t.filetab[off:])
+}
+
+// pcRange is a range of PCs [lo, hi) that share the same value in a
+// pcvalue table.
+type pcRange struct {
+	lo, hi uint64
+	val    int32
+}
+
+// pcvalues decodes the pcvalue table at offset off in pctab for the
+// function starting at entry.
+func (t *pclntab) pcvalues(off uint32, entry uint64) []pcRange {
+	if off == 0 || int(off) >= len(t.pctab) {
+		return nil
+	}
+	p := t.pctab[off:]
+	var rs []pcRange
+	pc, val := entry, int32(-1)
+	for first := true; len(p) > 0; first = false {
+		uvdelta, n := binary.Uvarint(p)
+		if n <= 0 || uvdelta == 0 && !first {
+			break
+		}
+		p = p[n:]
+		if uvdelta&1 != 0 {
+			uvdelta = ^(uvdelta >> 1)
+		} else {
+			uvdelta >>= 1
+		}
+		pcdelta, n := binary.Uvarint(p)
+		if n <= 0 {
+			break
+		}
+		p = p[n:]
+		val += int32(uvdelta)
+		rs = append(rs, pcRange{lo: pc, hi: pc + pcdelta*t.quantum, val: val})
+		pc += pcdelta * t.quantum
+	}
+	return rs
+}
+
+// funcInfo is the runtime metadata for one function, the _func
+// structure in runtime/runtime2.go.
+type funcInfo struct {
+	t          *pclntab
+	b          []byte // starts at the _func
+	entry, end uint64
+}
+
+// field returns the nth uint32 field of the _func, counting from
+// nameOff. In Go 1.16 and Go 1.17 the _func starts with a pointer sized
+// entry, afterwards with a uint32 entry offset.
+func (f *funcInfo) field(n int) uint32 {
+	off := 4 + 4*n
+	if f.t.magic == go116magic {
+		off = f.t.ptrsize + 4*n
+	}
+	return f.t.bo.Uint32(f.b[off:])
+}
+
+func (f *funcInfo) nameOff() int32      { return int32(f.field(0)) }
+func (f *funcInfo) args() int32         { return int32(f.field(1)) }
+func (f *funcInfo) deferreturn() uint32 { return f.field(2) }
+func (f *funcInfo) pcsp() uint32        { return f.field(3) }
+func (f *funcInfo) pcfile() uint32      { return f.field(4) }
+func (f *funcInfo) pcln() uint32        { return f.field(5) }
+func (f *funcInfo) npcdata() uint32     { return f.field(6) }
+func (f *funcInfo) cuOffset() uint32    { return f.field(7) }
+
+// startLine returns the line of the func keyword, or 0 for binaries
+// older than Go 1.20 where this information is unavailable.
+func (f *funcInfo) startLine() int32 {
+	if f.t.magic != go120magic {
+		return 0
+	}
+	return int32(f.field(8))
+}
+
+// tail returns the bytes starting at funcID.
+func (f *funcInfo) tail() []byte {
+	n := 8
+	if f.t.magic == go120magic {
+		n = 9
+	}
+	off := 4 + 4*n
+	if f.t.magic == go116magic {
+		off = f.t.ptrsize + 4*n
+	}
+	return f.b[off:]
+}
+
+func (f *funcInfo) funcID() uint8    { return f.tail()[0] }
+func (f *funcInfo) nfuncdata() uint8 { return f.tail()[3] }
+
+// flag returns the function flags. Go 1.16 binaries have padding
+// there, so the flags are always zero.
+func (f *funcInfo) flag() uint8 { return f.tail()[1] }
+
+func (f *funcInfo) name() string {
+	return f.t.funcName(f.nameOff())
+}
+
+// pcdata returns the offset in pctab of the ith pcdata table, or 0 if
+// there is no such table.
+func (f *funcInfo) pcdata(i int) uint32 {
+	if i >= int(f.npcdata()) {
+		return 0
+	}
+	return f.t.bo.Uint32(f.tail()[4+4*i:])
+}
+
+// fileLine returns the file and line ranges of the function.
+func (f *funcInfo) fileLine() (files, lines []pcRange) {
+	return f.t.pcvalues(f.pcfile(), f.entry), f.t.pcvalues(f.pcln(), f.entry)
+}
+
+// funcdata returns the address of the ith funcdata, or 0 if there is no
+// such funcdata.
+func (f *funcInfo) funcdata(i int) uint64 {
+	if i >= int(f.nfuncdata()) {
+		return 0
+	}
+	p := f.tail()[4+4*f.npcdata():]
+	if f.t.magic == go116magic {
+		// An array of pointers, aligned.
+		if f.t.ptrsize == 8 && (len(f.t.data)-len(p))&4 != 0 {
+			p = p[4:]
+		}
+		return f.t.uintptr(p[i*f.t.ptrsize:])
+	}
+	off := f.t.bo.Uint32(p[4*i:])
+	if off == ^uint32(0) || f.t.gofunc == 0 {
+		return 0
+	}
+	return f.t.gofunc + uint64(off)
+}
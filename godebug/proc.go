@@ -0,0 +1,130 @@
+package godebug
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A Mapping is a region of the address space of a process, a line in
+// /proc/PID/maps.
+type Mapping struct {
+	Start, End uint64
+	Perm       string // e.g. r-xp
+	Offset     uint64 // offset in the file
+	Inode      uint64
+	Path       string // as seen in the mount namespace of the process
+}
+
+// ProcMaps returns the memory mappings of process pid.
+func ProcMaps(pid int) ([]Mapping, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var maps []Mapping
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// 00400000-0049b000 r-xp 00000000 fd:01 1234 /usr/bin/prog
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("bad line in /proc/%d/maps: %s", pid, s.Text())
+		}
+		var m Mapping
+		start, end, _ := strings.Cut(fields[0], "-")
+		m.Start, err = strconv.ParseUint(start, 16, 64)
+		if err == nil {
+			m.End, err = strconv.ParseUint(end, 16, 64)
+		}
+		if err == nil {
+			m.Offset, err = strconv.ParseUint(fields[2], 16, 64)
+		}
+		if err == nil {
+			m.Inode, err = strconv.ParseUint(fields[4], 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad line in /proc/%d/maps: %s", pid, s.Text())
+		}
+		m.Perm = fields[1]
+		if len(fields) > 5 {
+			m.Path = strings.Join(fields[5:], " ")
+		}
+		maps = append(maps, m)
+	}
+	return maps, s.Err()
+}
+
+// NewProgFromPID returns the Prog that is running as process pid.
+//
+// The executable is looked up in the mount namespace of the process.
+// If the file on disk is not the one running anymore, because it was
+// deleted or replaced, the Prog is read from the running image through
+// /proc/PID/exe, which remains valid only while the process is alive.
+func NewProgFromPID(pid int) (*Prog, error) {
+	proc := fmt.Sprintf("/proc/%d", pid)
+	exe, err := os.Readlink(proc + "/exe")
+	if err != nil {
+		return nil, err
+	}
+	maps, err := ProcMaps(pid)
+	if err != nil {
+		return nil, err
+	}
+	running, err := elf.Open(proc + "/exe")
+	if err != nil {
+		return nil, err
+	}
+	defer running.Close()
+
+	file := filepath.Join(proc, "root", strings.TrimSuffix(exe, " (deleted)"))
+	if f, err := elf.Open(file); err == nil {
+		same := sameBuild(f, running)
+		f.Close()
+		if !same {
+			file = proc + "/exe"
+		}
+	} else {
+		file = proc + "/exe"
+	}
+	p, err := newProg(file)
+	if err != nil {
+		return nil, err
+	}
+	p.PID = pid
+	p.Maps = maps
+	// The mapping of the text segment determines the load bias, which
+	// is non-zero for position independent executables.
+	if base, ok := exeBase(maps, exe); ok {
+		p.bias = base - p.load
+	}
+	return p, nil
+}
+
+// Bias returns the difference between the run time and the link time
+// addresses of the program. It is non-zero only for position independent
+// executables attached to with NewProgFromPID.
+func (p *Prog) Bias() uint64 {
+	return p.bias
+}
+
+// Objects returns the paths of the files mapped in the process, as seen
+// from the mount namespace of the debugger, and their load bases, the
+// address where the start of the file is mapped.
+func (p *Prog) Objects() map[string]uint64 {
+	objs := make(map[string]uint64)
+	for _, m := range p.Maps {
+		if !strings.HasPrefix(m.Path, "/") || m.Inode == 0 {
+			continue
+		}
+		path := filepath.Join(fmt.Sprintf("/proc/%d/root", p.PID), m.Path)
+		if base, ok := objs[path]; !ok || m.Start-m.Offset < base {
+			objs[path] = m.Start - m.Offset
+		}
+	}
+	return objs
+}
@@ -0,0 +1,184 @@
+package godebug
+
+import (
+	"bytes"
+	"debug/gosym"
+	"strings"
+)
+
+// Function flags in the runtime symbol table. See internal/abi/symtab.go
+// in the Go distribution.
+const (
+	funcFlagTopFrame = 1 << iota // outermost frame, like runtime.goexit
+	funcFlagSPWrite              // writes SP, like runtime.systemstack
+	funcFlagAsm                  // written in assembly
+)
+
+// argsSizeUnknown is the args size of assembly functions that don't
+// declare their frame.
+const argsSizeUnknown = -0x80000000
+
+// Functions with a special funcID that are ordinary Go code and can be
+// probed. Other functions with a special funcID switch stacks, run
+// without a g, or don't return.
+var benignFuncIDs = map[string]bool{
+	"runtime.main":           true,
+	"runtime.gopanic":        true,
+	"runtime.gcBgMarkWorker": true,
+	"runtime.runfinq":        true,
+	"runtime.runFinalizers":  true,
+	"runtime.runCleanups":    true,
+	"runtime.panicwrap":      true,
+}
+
+// Runtime functions that run in signal handlers or in the middle of
+// stack growth, where a probe can deadlock the program.
+var unsafeNames = map[string]string{
+	"runtime.morestack":            "stack growth",
+	"runtime.morestack_noctxt":     "stack growth",
+	"runtime.newstack":             "stack growth",
+	"runtime.sigtramp":             "signal handler",
+	"runtime.sigtrampgo":           "signal handler",
+	"runtime.cgoSigtramp":          "signal handler",
+	"runtime.sighandler":           "signal handler",
+	"runtime.sigreturn":            "signal handler",
+	"runtime.sigreturn__sigaction": "signal handler",
+	"runtime.sigfwd":               "signal handler",
+	"runtime.sigfwdgo":             "signal handler",
+	"runtime.sigprof":              "signal handler",
+	"runtime.sigprofNonGo":         "signal handler",
+	"runtime.sigprofNonGoPC":       "signal handler",
+	"runtime.sigprofNonGoWrapper":  "signal handler",
+	"runtime.badsignal":            "signal handler",
+	"runtime.adjustSignalStack":    "signal handler",
+	"runtime.doSigPreempt":         "signal handler",
+	"runtime.sigpanic":             "signal handler",
+	"runtime.sigpanic0":            "signal handler",
+}
+
+// stackCheckLen is how far into a function the stack check is looked
+// for. Functions with big frames compute the new stack pointer first.
+const stackCheckLen = 32
+
+// An UnsafeFunc is a function that is not safe to probe.
+type UnsafeFunc struct {
+	Func   *gosym.Func
+	Reason string
+}
+
+// Unsafe returns why probing the function could hang or crash the
+// program, or "" if it's safe to probe.
+func (p *Prog) Unsafe(fn *gosym.Func) string {
+	p.initUnsafe()
+	return p.unsafe[fn.Entry]
+}
+
+// CUnsafe is like Unsafe, for C functions. Functions of the program in
+// Go code are Go functions by another name, and are checked like them.
+func (p *Prog) CUnsafe(fn CFunc) string {
+	if fn.Path != p.path {
+		return ""
+	}
+	if gofn := p.PCToFunc(fn.Value); gofn != nil {
+		return p.Unsafe(gofn)
+	}
+	return ""
+}
+
+// UnsafeFuncs returns the functions of the program that are not safe to
+// probe, sorted by address.
+func (p *Prog) UnsafeFuncs() []UnsafeFunc {
+	p.initUnsafe()
+	var fns []UnsafeFunc
+	for i := range p.Funcs {
+		fn := &p.Funcs[i]
+		if r := p.unsafe[fn.Entry]; r != "" {
+			fns = append(fns, UnsafeFunc{fn, r})
+		}
+	}
+	return fns
+}
+
+// initUnsafe classifies the functions of the program, using the flags
+// and the funcID recorded by the toolchain, their names and their
+// prologues.
+func (p *Prog) initUnsafe() {
+	if p.unsafe != nil {
+		return
+	}
+	p.unsafe = make(map[uint64]string)
+	if p.pcln == nil {
+		// Without the runtime metadata, go by name only.
+		for _, fn := range p.Funcs {
+			if r := unsafeNames[fn.Name]; r != "" {
+				p.unsafe[fn.Entry] = r
+			}
+		}
+		return
+	}
+	fns := p.pcln.funcs()
+	// The funcID of wrappers is the last one in every Go release, and
+	// every program has wrappers.
+	var wrapper uint8
+	count := make(map[string]int)
+	for _, f := range fns {
+		if id := f.funcID(); id > wrapper {
+			wrapper = id
+		}
+		count[f.name()]++
+	}
+	for _, f := range fns {
+		name := f.name()
+		var r string
+		switch flag, id := f.flag(), f.funcID(); {
+		case flag&funcFlagTopFrame != 0:
+			r = "outermost frame (TOPFRAME)"
+		case flag&funcFlagSPWrite != 0:
+			r = "switches stacks (SPWRITE)"
+		case unsafeNames[name] != "":
+			r = unsafeNames[name]
+		case id != 0 && id != wrapper && !benignFuncIDs[name]:
+			r = "special runtime function"
+		case flag&funcFlagAsm != 0 && f.args() == argsSizeUnknown:
+			r = "assembly without frame info"
+		case id == wrapper && count[name] > 1:
+			// ABI wrappers have the name of the function they wrap.
+			r = "ABI wrapper"
+		case flag&funcFlagAsm == 0 && isRuntime(name) && !p.hasStackCheck(f.entry, f.end):
+			r = "nosplit runtime function"
+		}
+		if r != "" {
+			p.unsafe[f.entry] = r
+		}
+	}
+}
+
+// isRuntime reports whether the function is part of the runtime.
+func isRuntime(name string) bool {
+	pkg := SplitName(name).Package
+	return pkg == "runtime" || strings.HasPrefix(pkg, "runtime/") || strings.HasPrefix(pkg, "internal/runtime/")
+}
+
+// hasStackCheck reports whether the function in [entry, end) checks for
+// stack overflow in its prologue, which nosplit functions don't. It
+// returns true if it can't tell.
+func (p *Prog) hasStackCheck(entry, end uint64) bool {
+	checks := p.arch.stackChecks
+	if checks == nil {
+		return true
+	}
+	n := end - entry
+	if n > stackCheckLen {
+		n = stackCheckLen
+	}
+	b, err := p.read(entry, int(n))
+	if err != nil {
+		return true
+	}
+	for _, c := range checks {
+		if bytes.Contains(b, c) {
+			return true
+		}
+	}
+	return false
+}
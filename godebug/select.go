@@ -0,0 +1,212 @@
+package godebug
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Selector selects functions by their properties rather than by
+// matching their names with regular expressions. A selector is a list
+// of space separated terms, and a function is selected if it satisfies
+// all of them. A term prefixed with ! is negated. The terms are:
+//
+//	pkg:GLOB     the package path matches GLOB, e.g. pkg:net/http
+//	recv:GLOB    the method receiver matches GLOB, e.g. recv:*response
+//	             for pointer receivers, recv:response for value ones
+//	method:GLOB  the function is a method and its name matches GLOB
+//	func:GLOB    the function or method name matches GLOB
+//	inst:GLOB    the generic instantiation matches GLOB, e.g. inst:*int*
+//	file:GLOB    the source file, or its base name, matches GLOB
+//	re:REGEXP    the full name matches REGEXP
+//	exported     the function or method name is exported
+//	generic      the function is a generic instantiation
+//	closure      the function is a closure or a go/defer wrapper
+//	runtime      the function is in package runtime, runtime/... or in
+//	             an internal package
+//
+// Globs use the syntax of path.Match, except that * also matches /.
+// Pointer receivers are written with a * and without parentheses. The
+// leading * of a recv glob stands for the pointer, not for any text, so
+// recv:*response doesn't match the value receiver response, and
+// recv:** only matches pointer receivers. recv:* alone matches all
+// receivers. So
+//
+//	pkg:net/http recv:*response method:Write* !file:*_test.go
+//
+// selects the Write methods of *net/http.response.
+type Selector struct {
+	src   string
+	terms []term
+}
+
+type term struct {
+	not   bool
+	key   string
+	glob  string
+	regex *regexp.Regexp
+}
+
+var selectorKeys = map[string]bool{
+	"pkg": true, "recv": true, "method": true, "func": true,
+	"inst": true, "file": true, "re": true,
+}
+
+var selectorPredicates = map[string]bool{
+	"exported": true, "generic": true, "closure": true, "runtime": true,
+}
+
+// ParseSelector parses a selector.
+func ParseSelector(s string) (*Selector, error) {
+	sel := &Selector{src: s}
+	for _, f := range strings.Fields(s) {
+		var t term
+		if strings.HasPrefix(f, "!") {
+			t.not = true
+			f = f[1:]
+		}
+		key, val, ok := strings.Cut(f, ":")
+		switch {
+		case !ok && selectorPredicates[key]:
+			t.key = key
+		case ok && key == "re":
+			re, err := regexp.Compile(val)
+			if err != nil {
+				return nil, fmt.Errorf("selector %q: %v", s, err)
+			}
+			t.key, t.regex = key, re
+		case ok && selectorKeys[key]:
+			if _, err := path.Match(val, ""); err != nil {
+				return nil, fmt.Errorf("selector %q: bad pattern %s", s, val)
+			}
+			t.key, t.glob = key, val
+		default:
+			return nil, fmt.Errorf("selector %q: unknown term %s", s, f)
+		}
+		sel.terms = append(sel.terms, t)
+	}
+	return sel, nil
+}
+
+func (s *Selector) String() string {
+	return s.src
+}
+
+// Match reports whether the function with the specified name, defined
+// in file, is selected. file may be empty if unknown, in which case
+// file terms don't match.
+func (s *Selector) Match(name, file string) bool {
+	n := SplitName(name)
+	for _, t := range s.terms {
+		if t.match(name, file, n) == t.not {
+			return false
+		}
+	}
+	return true
+}
+
+func (t term) match(name, file string, n Name) bool {
+	switch t.key {
+	case "pkg":
+		return glob(t.glob, n.Package)
+	case "recv":
+		return n.Receiver != "" && recvGlob(t.glob, n.Receiver)
+	case "method":
+		return n.Receiver != "" && glob(t.glob, n.Func)
+	case "func":
+		return glob(t.glob, n.Func)
+	case "inst":
+		return n.Inst != "" && glob(t.glob, n.Inst)
+	case "file":
+		return file != "" && (glob(t.glob, file) || glob(t.glob, path.Base(file)))
+	case "re":
+		return t.regex.MatchString(name)
+	case "exported":
+		r, _ := utf8.DecodeRuneInString(n.Func)
+		return unicode.IsUpper(r)
+	case "generic":
+		return n.Inst != ""
+	case "closure":
+		return anonSuffix(n.Closure) != ""
+	case "runtime":
+		p := n.Package
+		return p == "runtime" || strings.HasPrefix(p, "runtime/") ||
+			p == "internal" || strings.HasPrefix(p, "internal/") ||
+			strings.Contains(p, "/internal/") || strings.HasSuffix(p, "/internal")
+	}
+	panic("unreachable")
+}
+
+// glob is like path.Match except * also matches /.
+func glob(pattern, name string) bool {
+	ok, _ := path.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(name, "/", "\x00"))
+	return ok
+}
+
+// recvGlob is like glob, except that a leading * of pattern matches
+// the * of a pointer receiver, and only that, unless pattern is *.
+func recvGlob(pattern, recv string) bool {
+	if pattern == "*" {
+		return true
+	}
+	p, ptr := strings.CutPrefix(pattern, "*")
+	r, isPtr := strings.CutPrefix(recv, "*")
+	return ptr == isPtr && glob(p, r)
+}
+
+// A Name is a Go symbol name split into its parts. For example,
+// net/http.(*response).Write.func1 is Package net/http, Receiver
+// *response, Func Write and Closure func1.
+type Name struct {
+	Package  string
+	Receiver string // receiver type, with a leading * for pointers
+	Func     string // function or method name
+	Inst     string // type arguments of generic instantiations
+	Closure  string // closure or wrapper suffix, e.g. func1.2 or gowrap1
+}
+
+var closurePart = regexp.MustCompile(`^(func|gowrap|deferwrap)?[0-9]+$`)
+
+// SplitName splits a Go symbol name into its parts.
+func SplitName(name string) Name {
+	var n Name
+	// Take out the type arguments, which can contain anything.
+	if i := strings.Index(name, "["); i >= 0 {
+		if j := strings.LastIndex(name, "]"); j > i {
+			n.Inst = name[i+1 : j]
+			name = name[:i] + name[j+1:]
+		}
+	}
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		n.Func = name
+		return n
+	}
+	// The linker escapes dots in the last element of the package
+	// path, as in gopkg.in/yaml%2ev3.
+	n.Package = strings.ReplaceAll(name[:slash+1+dot], "%2e", ".")
+	rest := name[slash+1+dot+1:]
+	if strings.HasPrefix(rest, "(") {
+		if i := strings.Index(rest, ")"); i > 0 {
+			n.Receiver = rest[1:i]
+			rest = strings.TrimPrefix(rest[i+1:], ".")
+		}
+	}
+	parts := strings.Split(rest, ".")
+	i := len(parts)
+	for i > 1 && closurePart.MatchString(parts[i-1]) {
+		i--
+	}
+	n.Closure = strings.Join(parts[i:], ".")
+	parts = parts[:i]
+	if n.Receiver == "" && len(parts) == 2 {
+		n.Receiver = parts[0]
+		parts = parts[1:]
+	}
+	n.Func = strings.TrimSuffix(strings.Join(parts, "."), "-fm")
+	return n
+}
@@ -0,0 +1,276 @@
+package godebug
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A Frame is a call of a function, as seen from a PC in it.
+type Frame struct {
+	Func    string
+	File    string // position of the PC in the function
+	Line    int
+	Inlined bool // the call has been inlined into the next frame
+}
+
+func (f Frame) String() string {
+	s := fmt.Sprintf("%s %s:%d", f.Func, f.File, f.Line)
+	if f.Inlined {
+		s += " (inlined)"
+	}
+	return s
+}
+
+// maxInlineDepth bounds the walk up the inline tree, which could loop in
+// a corrupt binary.
+const maxInlineDepth = 100
+
+// Frames returns the calls executing at pc, a link time address, the
+// calls inlined at pc first and the function containing pc last. It
+// returns nil if pc is not in a Go function.
+//
+// For return addresses, which point after the call, pass the address of
+// the call instruction or return address - 1, or the position will be
+// the one of the next instruction, maybe in another inlined call.
+func (p *Prog) Frames(pc uint64) []Frame {
+	if fs, ok := p.frames[pc]; ok {
+		return fs
+	}
+	fs := p.frames1(pc)
+	if p.frames == nil {
+		p.frames = make(map[uint64][]Frame)
+	}
+	p.frames[pc] = fs
+	return fs
+}
+
+func (p *Prog) frames1(pc uint64) []Frame {
+	fn := p.PCToFunc(pc)
+	if fn == nil {
+		return nil
+	}
+	file, line, _ := p.PCToLine(pc)
+	var fs []Frame
+	if p.pcln != nil {
+		if f := p.pcln.funcFor(pc); f != nil {
+			fs, file, line = p.inlineFrames(f, pc, file, line)
+		}
+	}
+	return append(fs, Frame{Func: fn.Name, File: file, Line: line})
+}
+
+// inlineFrames returns the calls inlined at pc in f, innermost first,
+// and the position of the outermost call in f. file and line are the
+// position of pc, which is in the innermost call; the position of every
+// call is in its caller.
+func (p *Prog) inlineFrames(f *funcInfo, pc uint64, file string, line int) ([]Frame, string, int) {
+	tree := f.funcdata(funcdataInlTree)
+	if tree == 0 {
+		return nil, file, line
+	}
+	ranges := p.pcln.pcvalues(f.pcdata(pcdataInlTreeIndex), f.entry)
+	i := -1
+	for _, r := range ranges {
+		if r.lo <= pc && pc < r.hi {
+			i = int(r.val)
+			break
+		}
+	}
+	var fs []Frame
+	for depth := 0; i >= 0 && depth < maxInlineDepth; depth++ {
+		c, err := p.inlinedCall(tree, i, f, ranges)
+		if err != nil {
+			break
+		}
+		fs = append(fs, Frame{Func: c.name, File: file, Line: line, Inlined: true})
+		file, line, _ = p.PCToLine(f.entry + c.parentPc)
+		if c.parent == i {
+			break
+		}
+		i = c.parent
+	}
+	return fs, file, line
+}
+
+// LoadBase returns the address where the start of the executable of p is
+// mapped in process pid, running p. For executables that are not
+// position independent, that's the link time address.
+func (p *Prog) LoadBase(pid int) (uint64, error) {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return 0, err
+	}
+	maps, err := ProcMaps(pid)
+	if err != nil {
+		return 0, err
+	}
+	if base, ok := exeBase(maps, exe); ok {
+		return base, nil
+	}
+	return 0, fmt.Errorf("%s is not mapped in process %d", exe, pid)
+}
+
+// exeBase returns the address where the start of exe is mapped, from the
+// mapping of its text segment.
+func exeBase(maps []Mapping, exe string) (uint64, bool) {
+	for _, m := range maps {
+		if m.Path == exe && strings.HasPrefix(m.Perm, "r-x") {
+			return m.Start - m.Offset, true
+		}
+	}
+	return 0, false
+}
+
+// A Symbolizer turns the addresses of processes running a Prog back into
+// frames. Position independent executables are mapped at a different
+// address in every process, and their addresses are adjusted by the load
+// base of the process.
+type Symbolizer struct {
+	p *Prog
+
+	// Base returns the load base of process pid, see LoadBase. If
+	// Base is nil, or returns false, the addresses of executables
+	// that are not position independent are their link time
+	// addresses, and those of position independent ones can't be
+	// symbolized.
+	Base func(pid int) (uint64, bool)
+
+	same map[string]bool // whether a path is the executable of p
+}
+
+// NewSymbolizer returns a Symbolizer of the addresses of p.
+func NewSymbolizer(p *Prog) *Symbolizer {
+	return &Symbolizer{p: p, same: make(map[string]bool)}
+}
+
+// Frames returns the calls executing at addr in process pid, see
+// Prog.Frames.
+func (s *Symbolizer) Frames(pid int, addr uint64) []Frame {
+	base, ok := uint64(0), false
+	if s.Base != nil {
+		base, ok = s.Base(pid)
+	}
+	switch {
+	case ok:
+		addr = addr - base + s.p.load
+	case s.p.Type == elf.ET_DYN:
+		// Position independent, and nowhere to be found.
+		return nil
+	}
+	return s.p.Frames(addr)
+}
+
+// Stack returns the frames of the stack of process pid described by
+// addrs, the PC of the innermost frame followed by return addresses.
+// Addresses outside Go code give frames without a function.
+func (s *Symbolizer) Stack(pid int, addrs []uint64) []Frame {
+	var fs []Frame
+	for i, addr := range addrs {
+		if i > 0 {
+			addr--
+		}
+		f := s.Frames(pid, addr)
+		if f == nil {
+			f = []Frame{{Func: fmt.Sprintf("%#x", addrs[i])}}
+		}
+		fs = append(fs, f...)
+	}
+	return fs
+}
+
+var (
+	// The header of an event, up to the CPU, as in
+	//            prog-1234    [001] or prog-1234    (  1234) [001]
+	traceHeader = regexp.MustCompile(`^\s*.*-([0-9]+)\s+(\(\s*[0-9-]+\)\s+)?\[[0-9]+\]`)
+
+	// A user stack entry, a run time address or, with the
+	// sym-userobj trace option, an offset in the mapping of a file.
+	stackAddr   = regexp.MustCompile(`^ =>\s+<([0-9a-f]+)>$`)
+	stackOffset = regexp.MustCompile(`^ => (.*)\[\+0x([0-9a-f]+)\]( <[0-9a-f]+>)?$`)
+)
+
+// Copy copies the text of a kernel trace from r to w, replacing the
+// entries of the user stack traces in the program by the frames they
+// stand for, innermost first. Other lines are copied as they are.
+func (s *Symbolizer) Copy(w io.Writer, r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	pid, n := 0, 0 // current process and number of stack entries seen
+	for sc.Scan() {
+		line := sc.Text()
+		var fs []Frame
+		switch {
+		case strings.HasPrefix(line, " => "):
+			if m := stackOffset.FindStringSubmatch(line); m != nil && s.isExe(m[1]) {
+				off, _ := strconv.ParseUint(m[2], 16, 64)
+				fs = s.p.Frames(s.p.PC(s.p.textMapOffset()+off) - min(uint64(n), 1))
+			} else if m := stackAddr.FindStringSubmatch(line); m != nil {
+				addr, _ := strconv.ParseUint(m[1], 16, 64)
+				fs = s.Frames(pid, addr-min(uint64(n), 1))
+			}
+			n++
+		default:
+			if m := traceHeader.FindStringSubmatch(line); m != nil {
+				pid, _ = strconv.Atoi(m[1])
+				n = 0
+			}
+		}
+		var err error
+		if fs == nil {
+			_, err = fmt.Fprintln(w, line)
+		}
+		for _, f := range fs {
+			if err == nil {
+				_, err = fmt.Fprintf(w, " => %v\n", f)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// textMapOffset returns the offset in the executable of the start of the
+// mapping of its code. The kernel maps the text segment from the page it
+// starts in, and sym-userobj offsets are relative to the mapping. With
+// internal linking, that's the start of the file, but not with external
+// linking.
+func (p *Prog) textMapOffset() uint64 {
+	page := uint64(os.Getpagesize())
+	for _, s := range p.Progs {
+		if s.Type == elf.PT_LOAD && s.Flags == elf.PF_X|elf.PF_R {
+			align := s.Align
+			if align == 0 || align > page {
+				align = page
+			}
+			return s.Off &^ (align - 1)
+		}
+	}
+	return 0
+}
+
+// isExe reports whether path, as printed by the kernel, is the
+// executable of the program. Traces read on another machine only have
+// the name to go by.
+func (s *Symbolizer) isExe(path string) bool {
+	same, ok := s.same[path]
+	if !ok {
+		fi1, err1 := os.Stat(path)
+		fi2, err2 := os.Stat(s.p.path)
+		if err1 == nil && err2 == nil {
+			same = os.SameFile(fi1, fi2)
+		} else {
+			same = filepath.Base(path) == filepath.Base(s.p.path)
+		}
+		s.same[path] = same
+	}
+	return same
+}
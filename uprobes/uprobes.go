@@ -1,14 +1,18 @@
 /*
 Package uprobes implements a small DSL that targets Linux Uprobes. You use it like this:
 
-	e1 := uprobes.NewEvent("malloc_entry", "/bin/bash", 0x747d0).Stack("stk", 0).Register("size", "x0").S64()
+	e1 := uprobes.NewEvent("malloc_entry", "/bin/bash", 0x747d0).Stack("stk", 0).Register("size", "di").S64()
 	e2 := uprobes.NewEvent("malloc_return", "/bin/bash", 0x747d0).Return().Stack("", 0).RetVal("ret")
 
 These will generate the following uprobe "code":
 
-	p:malloc_entry /bin/bash:0x747d0 stk=$stack size=%x0:s64
+	p:malloc_entry /bin/bash:0x747d0 stk=$stack size=%di:s64
 	r:malloc_return /bin/bash:0x747d0 $stack ret=$retval
 
+Registers are named the way the kernel names them for the machine of
+the probed program. Above, /bin/bash is an amd64 program, which gets the
+first argument of C functions in di; on arm64 it would be x0.
+
 Events are io.Readers so you can do this:
 
 	io.Copy(events, io.MultiReader(e1, e2))
@@ -52,6 +56,10 @@ type Event struct {
 	Offset    uint64 // offset where probe is inserted
 	FetchArgs Args   // probe arguments
 
+	// Desc is a human readable description of the event, for the
+	// people reading the trace. It's not part of the probe.
+	Desc string
+
 	r io.Reader
 }
 
@@ -106,6 +114,7 @@ func (e *Event) Read(b []byte) (_ int, _ error) {
 func (e *Event) Remove() *Event {
 	re := *e
 	re.Kind = "-"
+	re.r = nil
 	return &re
 }
 
@@ -113,6 +122,7 @@ func (e *Event) Remove() *Event {
 func (e *Event) Return() *Event {
 	re := *e
 	re.Kind = "r"
+	re.r = nil
 	return &re
 }
 
@@ -126,6 +136,15 @@ type Arg struct {
 	// offset from the actual argument, this is +|-offs(FETCHARG),
 	// NOT @+OFFSET
 	Offset uint64
+
+	// number of elements to fetch as an array, 0 for a single value
+	Len int
+
+	// Expr is the Go expression the argument reads, like req.URL.Path,
+	// and Result tells whether it's a return value, for the programs
+	// reading the trace. They are not part of the probe.
+	Expr   string
+	Result bool
 }
 
 // String return an argument in the format uprobe_events expects.
@@ -142,6 +161,9 @@ func (f *Arg) String() string {
 		s += ")"
 	}
 	s += f.Type.String()
+	if f.Len > 0 {
+		s += fmt.Sprintf("[%d]", f.Len)
+	}
 	return s
 }
 
@@ -160,6 +182,7 @@ const (
 	TypeS64
 	TypeString
 	TypeBitfield
+	TypeChar
 )
 
 // String returns the argument type in the format uprobe_events expects.
@@ -187,12 +210,14 @@ func (t Type) String() string {
 		return ":string"
 	case TypeBitfield:
 		return ":bitfield"
+	case TypeChar:
+		return ":char"
 	}
 	panic("unreachable")
 }
 
-// Register represents a register fetch in the canonical format, e.g. rax,
-// x1, etc.
+// Register represents a register fetch, named like the kernel names it,
+// e.g. ax or r14 on amd64, x1 on arm64, a0 on riscv64.
 type Register string
 
 func (r Register) String() string {
@@ -214,6 +239,18 @@ func (o Offset) String() string {
 	return fmt.Sprintf("@+0x%x", uint64(o))
 }
 
+// Deref represents a memory fetch from the address computed by another
+// fetch plus an offset, e.g. +8(%ax). Unlike Arg.Offset, derefs nest,
+// as in +16(+8(%ax)), and the offset can be negative.
+type Deref struct {
+	Value  fmt.Stringer
+	Offset int64
+}
+
+func (d Deref) String() string {
+	return fmt.Sprintf("%+d(%s)", d.Offset, d.Value)
+}
+
 // Stack fetches the nth entry of stack.
 type Stack int
 
@@ -277,6 +314,15 @@ func (e *Event) AddressOffset(name string, addr, off uint64) *Event {
 	return e
 }
 
+func (fa Args) Fetch(name string, v fmt.Stringer) Args {
+	return append(fa, Arg{Name: name, Value: v})
+}
+
+func (e *Event) Fetch(name string, v fmt.Stringer) *Event {
+	e.FetchArgs = e.FetchArgs.Fetch(name, v)
+	return e
+}
+
 func (fa Args) Stack(name string, N int) Args {
 	return append(fa, Arg{Name: name, Value: Stack(N)})
 }
@@ -424,3 +470,30 @@ func (e *Event) Bit() *Event {
 	e.FetchArgs = e.FetchArgs.Bit()
 	return e
 }
+
+func (fa Args) Char() Args {
+	if len(fa) == 0 {
+		return fa
+	}
+	fa[len(fa)-1].Type = TypeChar
+	return fa
+}
+
+func (e *Event) Char() *Event {
+	e.FetchArgs = e.FetchArgs.Char()
+	return e
+}
+
+// Array makes the last added Arg fetch n consecutive values of its type.
+func (fa Args) Array(n int) Args {
+	if len(fa) == 0 {
+		return fa
+	}
+	fa[len(fa)-1].Len = n
+	return fa
+}
+
+func (e *Event) Array(n int) *Event {
+	e.FetchArgs = e.FetchArgs.Array(n)
+	return e
+}